@@ -0,0 +1,294 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-ee/eventsoutcing_pocketbase/eventstore"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/hallgren/eventsourcing/core"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/tools/router"
+
+	pbcore "github.com/pocketbase/pocketbase/core"
+)
+
+const DefaultBasePath = "/api/es"
+const HeaderExpectedVersion = "ES-Expected-Version"
+
+const ParamAggType = "aggType"
+const ParamAggId = "aggId"
+const QueryAfter = "after"
+const QueryAfterGlobal = "afterGlobal"
+const QueryLimit = "limit"
+
+const DefaultLimit = 100
+const MaxLimit = 1000
+
+func New(store *eventstore.Store) *Routes {
+	return &Routes{
+		Store:    store,
+		BasePath: DefaultBasePath,
+	}
+}
+
+// Routes exposes the event streams of the store over HTTP, including a Server-Sent Events feed of the global stream.
+// Reads are restricted by the list rule, appends by the create rule of the aggregate collections.
+type Routes struct {
+	Store    *eventstore.Store
+	BasePath string
+	// KeepAlive is the interval of keep-alive comments on the SSE stream
+	KeepAlive time.Duration
+}
+
+// EventsResponse is the response body of the event lists
+type EventsResponse struct {
+	Items []*eventstore.JSONEvent `json:"items"`
+}
+
+// AppendRequest is the request body to append events to a stream
+type AppendRequest struct {
+	Events []AppendEvent `json:"events"`
+}
+
+type AppendEvent struct {
+	Reason   string          `json:"reason"`
+	Data     json.RawMessage `json:"data,omitempty"`
+	Metadata json.RawMessage `json:"metadata,omitempty"`
+}
+
+// Register binds the routes, when the app starts serving
+func (o *Routes) Register() {
+	o.Store.App().OnServe().BindFunc(func(se *pbcore.ServeEvent) error {
+		o.Bind(se.Router)
+		return se.Next()
+	})
+}
+
+func (o *Routes) Bind(r *router.Router[*pbcore.RequestEvent]) {
+	group := r.Group(o.BasePath)
+	group.GET("/events", o.listAll)
+	group.GET("/events/stream", o.streamAll)
+	group.GET(fmt.Sprintf("/{%v}/{%v}/events", ParamAggType, ParamAggId), o.listStream)
+	group.POST(fmt.Sprintf("/{%v}/{%v}/events", ParamAggType, ParamAggId), o.appendStream)
+	o.bindSequences(group)
+}
+
+func (o *Routes) listAll(e *pbcore.RequestEvent) (err error) {
+	var requestInfo *pbcore.RequestInfo
+	if requestInfo, err = e.RequestInfo(); err != nil {
+		return
+	}
+
+	var afterGlobal, limit uint64
+	if afterGlobal, err = queryUint(e, QueryAfterGlobal, 0); err != nil {
+		return
+	}
+	if limit, err = queryLimit(e); err != nil {
+		return
+	}
+
+	var events []core.Event
+	if events, err = o.Store.FindAfterGlobalVersion(e.Request.Context(), core.Version(afterGlobal), limit,
+		RuleFilter(e.App, requestInfo, ListRule)); err != nil {
+		return
+	}
+	err = e.JSON(http.StatusOK, EventsResponse{Items: eventstore.NewJSONEvents(events)})
+	return
+}
+
+func (o *Routes) listStream(e *pbcore.RequestEvent) (err error) {
+	var requestInfo *pbcore.RequestInfo
+	if requestInfo, err = e.RequestInfo(); err != nil {
+		return
+	}
+
+	var aggregate *eventstore.Aggregate
+	if aggregate, err = o.findAggregate(e, false); err != nil {
+		return
+	}
+	if !CanAccess(requestInfo, aggregate, ListRule) {
+		err = e.ForbiddenError("Only superusers can perform this action.", nil)
+		return
+	}
+
+	var after, limit uint64
+	if after, err = queryUint(e, QueryAfter, 0); err != nil {
+		return
+	}
+	if limit, err = queryLimit(e); err != nil {
+		return
+	}
+
+	iterator := eventstore.NewIterator(e.Request.Context(), aggregate, e.Request.PathValue(ParamAggId),
+		core.Version(after), int(limit)).WithFilter(RuleFilter(e.App, requestInfo, ListRule))
+	defer iterator.Close()
+
+	items := []*eventstore.JSONEvent{}
+	for uint64(len(items)) < limit && iterator.Next() {
+		var event core.Event
+		if event, err = iterator.Value(); err != nil {
+			return
+		}
+		items = append(items, eventstore.NewJSONEvent(&event))
+	}
+	err = e.JSON(http.StatusOK, EventsResponse{Items: items})
+	return
+}
+
+func (o *Routes) appendStream(e *pbcore.RequestEvent) (err error) {
+	var requestInfo *pbcore.RequestInfo
+	if requestInfo, err = e.RequestInfo(); err != nil {
+		return
+	}
+
+	// only superusers may create new aggregate types
+	var aggregate *eventstore.Aggregate
+	if aggregate, err = o.findAggregate(e, requestInfo.HasSuperuserAuth()); err != nil {
+		return
+	}
+	if !CanAccess(requestInfo, aggregate, CreateRule) {
+		err = e.ForbiddenError("Only superusers can perform this action.", nil)
+		return
+	}
+
+	expectedHeader := e.Request.Header.Get(HeaderExpectedVersion)
+	var expectedVersion uint64
+	if expectedVersion, err = strconv.ParseUint(expectedHeader, 10, 64); err != nil {
+		err = e.BadRequestError(fmt.Sprintf("Missing or invalid %v header.", HeaderExpectedVersion), err)
+		return
+	}
+
+	body := AppendRequest{}
+	if err = e.BindBody(&body); err != nil {
+		err = e.BadRequestError("Failed to read the request body.", err)
+		return
+	}
+	if len(body.Events) == 0 {
+		err = e.BadRequestError("No events to append.", nil)
+		return
+	}
+
+	aggId := e.Request.PathValue(ParamAggId)
+	events := make([]core.Event, len(body.Events))
+	now := time.Now()
+	for i, item := range body.Events {
+		if err = item.validate(); err != nil {
+			err = e.BadRequestError(fmt.Sprintf("Invalid event %d: %v", i+1, err), err)
+			return
+		}
+		events[i] = core.Event{
+			AggregateID:   aggId,
+			AggregateType: aggregate.AggregateType,
+			Version:       core.Version(expectedVersion) + core.Version(i+1),
+			Timestamp:     now,
+			Reason:        item.Reason,
+			Data:          item.Data,
+			Metadata:      item.Metadata,
+		}
+	}
+
+	err = o.Store.App().RunInTransaction(func(txApp pbcore.App) (txErr error) {
+		if txErr = o.Store.SaveMultiTx(txApp, events); txErr != nil {
+			return
+		}
+		// check the create rule against the inserted records, like PocketBase does for record creates
+		txErr = checkCreated(txApp, requestInfo, aggregate, events)
+		return
+	})
+
+	switch {
+	case err == nil:
+		err = e.JSON(http.StatusCreated, EventsResponse{Items: eventstore.NewJSONEvents(events)})
+	case errors.Is(err, core.ErrConcurrency):
+		err = e.Error(http.StatusConflict, "The stream was changed concurrently.", err)
+	case errors.Is(err, errForbidden):
+		err = e.ForbiddenError("You are not allowed to perform this request.", nil)
+	case errors.Is(err, eventstore.ErrKeyDestroyed):
+		err = e.Error(http.StatusConflict, "The key of the aggregate is destroyed.", err)
+	case errors.As(err, &validation.Errors{}):
+		err = e.BadRequestError("Failed to append the events.", err)
+	default:
+		err = e.InternalServerError("Failed to append the events.", err)
+	}
+	return
+}
+
+// validate checks the event of the request, the records validate the fields again when saved
+func (o *AppendEvent) validate() (err error) {
+	if o.Reason == "" {
+		err = errors.New("the reason is required")
+		return
+	}
+	if len(o.Metadata) > 0 {
+		var metadata map[string]any
+		if err = json.Unmarshal(o.Metadata, &metadata); err != nil {
+			err = fmt.Errorf("the metadata must be an object: %w", err)
+		}
+	}
+	return
+}
+
+var errForbidden = errors.New("forbidden")
+
+func checkCreated(txApp pbcore.App, requestInfo *pbcore.RequestInfo, aggregate *eventstore.Aggregate, events []core.Event) (err error) {
+	query := aggregate.RecordQuery(txApp).
+		AndWhere(dbx.HashExp{eventstore.AggTypeFieldAggId: events[0].AggregateID}).
+		AndWhere(dbx.Between(eventstore.AggTypeFieldVersion,
+			uint64(events[0].Version), uint64(events[len(events)-1].Version)))
+
+	if err = RuleFilter(txApp, requestInfo, CreateRule)(aggregate, query); err != nil {
+		return
+	}
+
+	var records []*pbcore.Record
+	if err = query.All(&records); err != nil {
+		return
+	}
+	if len(records) != len(events) {
+		err = errForbidden
+	}
+	return
+}
+
+func (o *Routes) findAggregate(e *pbcore.RequestEvent, create bool) (ret *eventstore.Aggregate, err error) {
+	aggType := e.Request.PathValue(ParamAggType)
+	if !create {
+		var exists bool
+		if exists, err = o.Store.AggregateTypes.Exists(aggType); err != nil {
+			return
+		}
+		if !exists {
+			err = e.NotFoundError("Unknown aggregate type.", nil)
+			return
+		}
+	}
+	ret, err = o.Store.GetOrCreateForAggType(aggType)
+	return
+}
+
+func queryLimit(e *pbcore.RequestEvent) (ret uint64, err error) {
+	if ret, err = queryUint(e, QueryLimit, DefaultLimit); err != nil {
+		return
+	}
+	if ret == 0 || ret > MaxLimit {
+		ret = MaxLimit
+	}
+	return
+}
+
+func queryUint(e *pbcore.RequestEvent, name string, defaultValue uint64) (ret uint64, err error) {
+	value := e.Request.URL.Query().Get(name)
+	if value == "" {
+		ret = defaultValue
+		return
+	}
+	if ret, err = strconv.ParseUint(value, 10, 64); err != nil {
+		err = e.BadRequestError(fmt.Sprintf("Invalid %v query parameter.", name), err)
+	}
+	return
+}
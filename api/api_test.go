@@ -0,0 +1,333 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-ee/eventsoutcing_pocketbase/db"
+	"github.com/go-ee/eventsoutcing_pocketbase/eventstore"
+	"github.com/go-ee/eventsoutcing_pocketbase/internal/testapp"
+	"github.com/hallgren/eventsourcing/core"
+	"github.com/pocketbase/pocketbase/apis"
+	pbcore "github.com/pocketbase/pocketbase/core"
+)
+
+func TestRoutes(t *testing.T) {
+	appInst, store := newTestStore(t)
+
+	r, err := apis.NewRouter(appInst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	New(store).Bind(r)
+	mux, err := r.BuildMux()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	superuser := newAuthToken(t, appInst, pbcore.CollectionNameSuperusers, "admin@example.com")
+	user := newAuthToken(t, appInst, db.UserCollName, "user@example.com")
+
+	body := `{"events":[{"reason":"Created","data":{"name":"p1"},"metadata":{"test":"hello"}}]}`
+	if rec := serve(mux, http.MethodPost, "/api/es/Person/p1/events", body, user, "0"); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for new aggregate type by user, got %d", rec.Code)
+	}
+	if rec := serve(mux, http.MethodPost, "/api/es/Person/p1/events", body, superuser, ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 without expected version, got %d", rec.Code)
+	}
+	if rec := serve(mux, http.MethodPost, "/api/es/Person/p1/events", body, superuser, "0"); rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %v", rec.Code, rec.Body.String())
+	}
+	if rec := serve(mux, http.MethodPost, "/api/es/Person/p1/events", body, superuser, "0"); rec.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d: %v", rec.Code, rec.Body.String())
+	}
+	if rec := serve(mux, http.MethodPost, "/api/es/Person/p1/events", body, user, "1"); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for user append, got %d: %v", rec.Code, rec.Body.String())
+	}
+	invalid := `{"events":[{"data":{"name":"p1"},"metadata":[1]}]}`
+	if rec := serve(mux, http.MethodPost, "/api/es/Person/p1/events", invalid, superuser, "1"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an invalid event, got %d: %v", rec.Code, rec.Body.String())
+	}
+
+	// an internal error is not reported as a bad request
+	store.GlobalVersions = failingAllocator{}
+	if rec := serve(mux, http.MethodPost, "/api/es/Person/p1/events", body, superuser, "1"); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500 for an internal error, got %d: %v", rec.Code, rec.Body.String())
+	}
+	store.GlobalVersions = nil
+
+	items := listEvents(t, mux, "/api/es/Person/p1/events?after=0", superuser)
+	if len(items) != 1 || items[0].Version != 1 || string(items[0].Data) != `{"name":"p1"}` {
+		t.Fatalf("unexpected stream events %v", items)
+	}
+
+	items = listEvents(t, mux, "/api/es/events?afterGlobal=0", superuser)
+	if len(items) != 1 || items[0].GlobalVersion == 0 {
+		t.Fatalf("unexpected global events %v", items)
+	}
+
+	if items = listEvents(t, mux, "/api/es/events?afterGlobal=0", user); len(items) != 0 {
+		t.Fatalf("expected no events for user without role, got %v", items)
+	}
+}
+
+func TestStreamAll(t *testing.T) {
+	appInst, store := newTestStore(t)
+
+	r, err := apis.NewRouter(appInst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	New(store).Bind(r)
+	mux, err := r.BuildMux()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	superuser := newAuthToken(t, appInst, pbcore.CollectionNameSuperusers, "admin@example.com")
+	saveEvent(t, store, "p1")
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/api/es/events/stream?afterGlobal=0", nil)
+	req.Header.Set("Authorization", superuser)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected response %d, %v", resp.StatusCode, resp.Header)
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	if id, event := readSSE(t, reader); id != "1" || event.AggregateID != "p1" {
+		t.Fatalf("expected replayed p1 with id 1, got %v: %v", id, event)
+	}
+
+	saveEvent(t, store, "p2")
+	if id, event := readSSE(t, reader); id != "2" || event.AggregateID != "p2" {
+		t.Fatalf("expected live p2 with id 2, got %v: %v", id, event)
+	}
+}
+
+func TestSequences(t *testing.T) {
+	appInst, store := newTestStore(t)
+
+	r, err := apis.NewRouter(appInst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	New(store).Bind(r)
+	mux, err := r.BuildMux()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	superuser := newAuthToken(t, appInst, pbcore.CollectionNameSuperusers, "admin@example.com")
+	user := newAuthToken(t, appInst, db.UserCollName, "user@example.com")
+
+	if rec := serve(mux, http.MethodGet, "/api/es/sequences", "", user, ""); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for user, got %d", rec.Code)
+	}
+	if rec := serve(mux, http.MethodPut, "/api/es/sequences/orders", `{"value":10}`, superuser, ""); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %v", rec.Code, rec.Body.String())
+	}
+	if rec := serve(mux, http.MethodPut, "/api/es/sequences/orders", `{"value":5}`, superuser, ""); rec.Code != http.StatusConflict {
+		t.Fatalf("expected 409 for backwards, got %d: %v", rec.Code, rec.Body.String())
+	}
+
+	rec := serve(mux, http.MethodPost, "/api/es/sequences/orders/reserve", `{"count":5}`, superuser, "")
+	reserved := ReserveResponse{}
+	if err = json.Unmarshal(rec.Body.Bytes(), &reserved); err != nil || reserved.First != 11 || reserved.Last != 15 {
+		t.Fatalf("unexpected reserve response %d: %v", rec.Code, rec.Body.String())
+	}
+
+	rec = serve(mux, http.MethodGet, "/api/es/sequences", "", superuser, "")
+	sequences := SequencesResponse{}
+	if err = json.Unmarshal(rec.Body.Bytes(), &sequences); err != nil || len(sequences.Items) != 1 ||
+		sequences.Items[0] != (SequenceResponse{Name: "orders", Value: 15}) {
+		t.Fatalf("unexpected sequences %d: %v", rec.Code, rec.Body.String())
+	}
+
+	if rec = serve(mux, http.MethodDelete, "/api/es/sequences/orders", "", superuser, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %v", rec.Code, rec.Body.String())
+	}
+	if next, err := store.Sequence.GetNext("orders"); err != nil || next != 1 {
+		t.Fatalf("expected a deleted sequence to start at 1, got %v, %v", next, err)
+	}
+
+	saveEvent(t, store, "p1")
+	if rec = serve(mux, http.MethodDelete, "/api/es/sequences/"+eventstore.GlobalVersionSequence, "", superuser, ""); rec.Code != http.StatusConflict {
+		t.Fatalf("expected 409 for the global version sequence of stored events, got %d: %v", rec.Code, rec.Body.String())
+	}
+}
+
+func TestSharedAuth(t *testing.T) {
+	appInst, store := newTestStoreWith(t, eventstore.StorageSingleCollection)
+
+	r, err := apis.NewRouter(appInst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	New(store).Bind(r)
+	mux, err := r.BuildMux()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, aggType := range []string{"Person", "Order"} {
+		if err = store.Save([]core.Event{{AggregateID: "42", AggregateType: aggType, Version: 1,
+			Timestamp: time.Now(), Reason: "Created", Data: []byte(`{"name":"test"}`)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the user is granted Person 42, the grant must not open Order 42 of the shared collection
+	token := newAuthToken(t, appInst, db.UserCollName, "user@example.com")
+	user, err := appInst.FindAuthRecordByEmail(db.UserCollName, "user@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authColl, err := appInst.FindCollectionByNameOrId(eventstore.EventsColName + "_auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grant := pbcore.NewRecord(authColl)
+	grant.Set(eventstore.AggTypeFieldAggType, "Person")
+	grant.Set(eventstore.AggTypeFieldAggId, "42")
+	grant.Set("users", user.Id)
+	if err = appInst.Save(grant); err != nil {
+		t.Fatal(err)
+	}
+
+	if items := listEvents(t, mux, "/api/es/Person/42/events?after=0", token); len(items) != 1 {
+		t.Fatalf("expected the granted Person events, got %v", items)
+	}
+	if items := listEvents(t, mux, "/api/es/Order/42/events?after=0", token); len(items) != 0 {
+		t.Fatalf("expected no Order events, got %v", items)
+	}
+	if items := listEvents(t, mux, "/api/es/events?afterGlobal=0", token); len(items) != 1 || items[0].AggregateType != "Person" {
+		t.Fatalf("expected only the Person event, got %v", items)
+	}
+}
+
+// failingAllocator fails the allocation of the global versions like an unavailable database
+type failingAllocator struct{}
+
+func (failingAllocator) GetNextMultipleTx(pbcore.App, string, int) ([]int, error) {
+	return nil, errors.New("database unavailable")
+}
+
+func saveEvent(t *testing.T, store *eventstore.Store, aggId string) {
+	t.Helper()
+	err := store.Save([]core.Event{{
+		AggregateID:   aggId,
+		AggregateType: "Person",
+		Version:       1,
+		Timestamp:     time.Now(),
+		Reason:        "Created",
+		Data:          []byte(`{"name":"test"}`),
+		Metadata:      []byte(`{"test":"hello"}`),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readSSE(t *testing.T, reader *bufio.Reader) (id string, event *eventstore.JSONEvent) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimSpace(line)
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "data: "):
+				event = &eventstore.JSONEvent{}
+				_ = json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), event)
+			case line == "" && event != nil:
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no SSE message received")
+	}
+	return
+}
+
+func listEvents(t *testing.T, mux http.Handler, url string, token string) []*eventstore.JSONEvent {
+	t.Helper()
+	rec := serve(mux, http.MethodGet, url, "", token, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 for %v, got %d: %v", url, rec.Code, rec.Body.String())
+	}
+	response := EventsResponse{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	return response.Items
+}
+
+func serve(mux http.Handler, method string, url string, body string, token string, expectedVersion string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", token)
+	if expectedVersion != "" {
+		req.Header.Set(HeaderExpectedVersion, expectedVersion)
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec
+}
+
+func newAuthToken(t *testing.T, appInst *testapp.Env, collection string, email string) string {
+	t.Helper()
+	coll, err := appInst.FindCollectionByNameOrId(collection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := pbcore.NewRecord(coll)
+	record.SetEmail(email)
+	record.SetPassword("1234567890")
+	if err = appInst.Save(record); err != nil {
+		t.Fatal(err)
+	}
+	token, err := record.NewAuthToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func newTestStore(t *testing.T) (appInst *testapp.Env, store *eventstore.Store) {
+	t.Helper()
+	return newTestStoreWith(t, eventstore.StorageCollectionPerType)
+}
+
+func newTestStoreWith(t *testing.T, storage eventstore.Storage) (appInst *testapp.Env, store *eventstore.Store) {
+	t.Helper()
+	appInst, user := testapp.New(t)
+	store = eventstore.New(user, testapp.AuthRoles, appInst)
+	store.Storage = storage
+	if err := store.Load(); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
@@ -0,0 +1,58 @@
+package api
+
+import (
+	"github.com/go-ee/eventsoutcing_pocketbase/eventstore"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/tools/search"
+
+	pbcore "github.com/pocketbase/pocketbase/core"
+)
+
+// AccessRule selects the rule of an aggregate collection to apply
+type AccessRule func(coll *pbcore.Collection) *string
+
+func ListRule(coll *pbcore.Collection) *string {
+	return coll.ListRule
+}
+
+func ViewRule(coll *pbcore.Collection) *string {
+	return coll.ViewRule
+}
+
+func CreateRule(coll *pbcore.Collection) *string {
+	return coll.CreateRule
+}
+
+// RuleFilter applies an access rule of the aggregate collections to the event queries,
+// the same way the PocketBase record APIs do. Collections accessible only by superusers are excluded.
+func RuleFilter(app pbcore.App, requestInfo *pbcore.RequestInfo, rule AccessRule) eventstore.QueryFilter {
+	return func(aggregate *eventstore.Aggregate, query *dbx.SelectQuery) (err error) {
+		if requestInfo.HasSuperuserAuth() {
+			return
+		}
+
+		accessRule := rule(aggregate.Collection)
+		if accessRule == nil {
+			query.AndWhere(dbx.NewExp("1 = 0"))
+			return
+		}
+		if *accessRule == "" {
+			return
+		}
+
+		resolver := pbcore.NewRecordFieldResolver(app, aggregate.Collection, requestInfo, true)
+
+		var expr dbx.Expression
+		if expr, err = search.FilterData(*accessRule).BuildExpr(resolver); err != nil {
+			return
+		}
+		query.AndWhere(expr).Distinct(true)
+		err = resolver.UpdateQuery(query)
+		return
+	}
+}
+
+// CanAccess checks the access rule of the aggregate collection, without evaluating record fields
+func CanAccess(requestInfo *pbcore.RequestInfo, aggregate *eventstore.Aggregate, rule AccessRule) bool {
+	return requestInfo.HasSuperuserAuth() || rule(aggregate.Collection) != nil
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+
+	"github.com/go-ee/eventsoutcing_pocketbase/db"
+	"github.com/go-ee/eventsoutcing_pocketbase/eventstore"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/tools/router"
+
+	pbcore "github.com/pocketbase/pocketbase/core"
+)
+
+const ParamSequence = "sequence"
+
+// SequenceResponse is the response body of a sequence
+type SequenceResponse struct {
+	Name  string `json:"name"`
+	Value int    `json:"value"`
+}
+
+// SequencesResponse is the response body of the sequence list
+type SequencesResponse struct {
+	Items []SequenceResponse `json:"items"`
+}
+
+// SetSequenceRequest is the request body to set a sequence forward
+type SetSequenceRequest struct {
+	Value int `json:"value"`
+}
+
+// ReserveRequest is the request body to reserve a range of a sequence
+type ReserveRequest struct {
+	Count int `json:"count"`
+}
+
+// ReserveResponse is the reserved range of a sequence
+type ReserveResponse struct {
+	Name  string `json:"name"`
+	First int    `json:"first"`
+	Last  int    `json:"last"`
+}
+
+// bindSequences binds the admin routes of the sequences, they are restricted to superusers
+func (o *Routes) bindSequences(group *router.RouterGroup[*pbcore.RequestEvent]) {
+	sequences := group.Group("/sequences").Bind(apis.RequireSuperuserAuth())
+	sequences.GET("", o.listSequences)
+	sequences.GET("/{"+ParamSequence+"}", o.getSequence)
+	sequences.PUT("/{"+ParamSequence+"}", o.setSequence)
+	sequences.DELETE("/{"+ParamSequence+"}", o.deleteSequence)
+	sequences.POST("/{"+ParamSequence+"}/reserve", o.reserveSequence)
+}
+
+func (o *Routes) listSequences(e *pbcore.RequestEvent) (err error) {
+	var sequences map[string]int
+	if sequences, err = o.Store.Sequence.List(); err != nil {
+		return
+	}
+
+	response := SequencesResponse{Items: []SequenceResponse{}}
+	for name, value := range sequences {
+		response.Items = append(response.Items, SequenceResponse{Name: name, Value: value})
+	}
+	sort.Slice(response.Items, func(i, j int) bool {
+		return response.Items[i].Name < response.Items[j].Name
+	})
+	err = e.JSON(http.StatusOK, response)
+	return
+}
+
+func (o *Routes) getSequence(e *pbcore.RequestEvent) (err error) {
+	name := e.Request.PathValue(ParamSequence)
+
+	var value int
+	if value, err = o.Store.Sequence.Current(name); err != nil {
+		return
+	}
+	err = e.JSON(http.StatusOK, SequenceResponse{Name: name, Value: value})
+	return
+}
+
+func (o *Routes) setSequence(e *pbcore.RequestEvent) (err error) {
+	name := e.Request.PathValue(ParamSequence)
+
+	body := SetSequenceRequest{}
+	if err = e.BindBody(&body); err != nil {
+		err = e.BadRequestError("Failed to read the request body.", err)
+		return
+	}
+
+	if err = o.Store.SetSequence(name, body.Value); err != nil {
+		if errors.Is(err, db.ErrSequenceBackwards) {
+			err = e.Error(http.StatusConflict, "The sequence must not move backwards.", err)
+		}
+		return
+	}
+	err = e.JSON(http.StatusOK, SequenceResponse{Name: name, Value: body.Value})
+	return
+}
+
+func (o *Routes) deleteSequence(e *pbcore.RequestEvent) (err error) {
+	if err = o.Store.DeleteSequence(e.Request.Context(), e.Request.PathValue(ParamSequence)); err != nil {
+		if errors.Is(err, eventstore.ErrSequenceInUse) {
+			err = e.Error(http.StatusConflict, "The sequence is in use by stored events.", err)
+		}
+		return
+	}
+	err = e.NoContent(http.StatusNoContent)
+	return
+}
+
+func (o *Routes) reserveSequence(e *pbcore.RequestEvent) (err error) {
+	name := e.Request.PathValue(ParamSequence)
+
+	body := ReserveRequest{}
+	if err = e.BindBody(&body); err != nil {
+		err = e.BadRequestError("Failed to read the request body.", err)
+		return
+	}
+	if body.Count <= 0 {
+		err = e.BadRequestError("The count must be positive.", nil)
+		return
+	}
+
+	response := ReserveResponse{Name: name}
+	if response.First, response.Last, err = o.Store.Sequence.Reserve(name, body.Count); err != nil {
+		return
+	}
+	err = e.JSON(http.StatusOK, response)
+	return
+}
@@ -0,0 +1,143 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-ee/eventsoutcing_pocketbase/eventstore"
+	"github.com/hallgren/eventsourcing/core"
+
+	pbcore "github.com/pocketbase/pocketbase/core"
+)
+
+const HeaderLastEventId = "Last-Event-ID"
+
+const SSEEventName = "event"
+const DefaultSSEKeepAlive = 15 * time.Second
+
+// streamAll replays the global event stream after the requested global version and then streams new events.
+// The SSE id of each message is the global version, so a reconnecting client resumes by Last-Event-ID.
+// Events are read from the store with the list rules applied, commit notifications only wake the stream up,
+// so the order is the global order and a slow client does not block saving.
+func (o *Routes) streamAll(e *pbcore.RequestEvent) (err error) {
+	var requestInfo *pbcore.RequestInfo
+	if requestInfo, err = e.RequestInfo(); err != nil {
+		return
+	}
+
+	var afterGlobal uint64
+	if lastEventId := e.Request.Header.Get(HeaderLastEventId); lastEventId != "" {
+		if afterGlobal, err = strconv.ParseUint(lastEventId, 10, 64); err != nil {
+			err = e.BadRequestError(fmt.Sprintf("Invalid %v header.", HeaderLastEventId), err)
+			return
+		}
+	} else if afterGlobal, err = queryUint(e, QueryAfterGlobal, 0); err != nil {
+		return
+	}
+
+	// disable global write deadline for the SSE connection
+	rc := http.NewResponseController(e.Response)
+	if deadlineErr := rc.SetWriteDeadline(time.Time{}); deadlineErr != nil && !errors.Is(deadlineErr, http.ErrNotSupported) {
+		err = e.InternalServerError("Failed to initialize SSE connection.", deadlineErr)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(e.Request.Context())
+	defer cancel()
+
+	// subscribe before the replay, so no commit is missed
+	notify := make(chan struct{}, 1)
+	var unsubscribe func()
+	if unsubscribe, err = o.Store.SubscribeFunc(eventstore.SubscriptionFilter{}, func(core.Event) {
+		select {
+		case notify <- struct{}{}:
+		default:
+		}
+	}); err != nil {
+		return
+	}
+	defer unsubscribe()
+
+	e.Response.Header().Set("Content-Type", "text/event-stream")
+	e.Response.Header().Set("Cache-Control", "no-store")
+	e.Response.Header().Set("X-Accel-Buffering", "no")
+	e.Response.WriteHeader(http.StatusOK)
+	if err = e.Flush(); err != nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(o.keepAlive())
+	defer keepAlive.Stop()
+
+	filter := RuleFilter(e.App, requestInfo, ListRule)
+	fetch := o.Store.AllFiltered(ctx, core.Version(afterGlobal), MaxLimit, filter)
+	for {
+		var sent int
+		if sent, err = writeBatch(e, fetch); err != nil {
+			if ctx.Err() != nil {
+				err = nil
+			}
+			return
+		}
+
+		// continue immediately while replaying
+		if sent >= MaxLimit {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-notify:
+		case <-keepAlive.C:
+			// SSE comment to keep proxies from closing the connection, new events are checked as well
+			if _, err = fmt.Fprint(e.Response, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			if err = e.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func writeBatch(e *pbcore.RequestEvent, fetch eventstore.Fetcher) (sent int, err error) {
+	var iterator core.Iterator
+	if iterator, err = fetch(); err != nil {
+		return
+	}
+	defer iterator.Close()
+
+	for iterator.Next() {
+		var event core.Event
+		if event, err = iterator.Value(); err != nil {
+			return
+		}
+
+		var data []byte
+		if data, err = json.Marshal(eventstore.NewJSONEvent(&event)); err != nil {
+			return
+		}
+		if _, err = fmt.Fprintf(e.Response, "id: %d\nevent: %v\ndata: %s\n\n", event.GlobalVersion, SSEEventName, data); err != nil {
+			return
+		}
+		sent++
+	}
+
+	if sent > 0 {
+		err = e.Flush()
+	}
+	return
+}
+
+func (o *Routes) keepAlive() time.Duration {
+	if o.KeepAlive > 0 {
+		return o.KeepAlive
+	}
+	return DefaultSSEKeepAlive
+}
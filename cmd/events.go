@@ -0,0 +1,335 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/go-ee/eventsoutcing_pocketbase/eventstore"
+	"github.com/hallgren/eventsourcing/core"
+	"github.com/pocketbase/pocketbase"
+	"github.com/spf13/cobra"
+)
+
+const DefaultFollowInterval = time.Second
+const DefaultBatchSize = 1000
+
+// Register adds the events command group to the root command of the PocketBase app
+func Register(pb *pocketbase.PocketBase, store *eventstore.Store) {
+	pb.RootCmd.AddCommand(NewEventsCommand(store))
+}
+
+// NewEventsCommand creates the events command group to inspect and operate the event store
+func NewEventsCommand(store *eventstore.Store) (ret *cobra.Command) {
+	ret = &cobra.Command{
+		Use:   "events",
+		Short: "Inspect and operate the event store",
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return store.Load()
+		},
+	}
+
+	ret.AddCommand(
+		newTypesCommand(store),
+		newShowCommand(store),
+		newTailCommand(store),
+		newCountCommand(store),
+		newSequenceCommand(store),
+		newExportCommand(store),
+		newImportCommand(store),
+		newShredCommand(store),
+		newMigrateStorageCommand(store),
+	)
+	return
+}
+
+func newTypesCommand(store *eventstore.Store) *cobra.Command {
+	return &cobra.Command{
+		Use:   "types",
+		Short: "List the aggregate types with their collections",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			var aggTypes map[string]string
+			if aggTypes, err = store.AggregateTypes.FindAll(); err != nil {
+				return
+			}
+			for _, aggType := range sortedKeys(aggTypes) {
+				fmt.Fprintf(cmd.OutOrStdout(), "%v\t%v\n", aggType, aggTypes[aggType])
+			}
+			return
+		},
+	}
+}
+
+func newShowCommand(store *eventstore.Store) *cobra.Command {
+	var after uint64
+	ret := &cobra.Command{
+		Use:   "show <aggType> <aggId>",
+		Short: "Print the events of an aggregate as JSON lines",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			var iterator core.Iterator
+			if iterator, err = store.Get(commandContext(cmd), args[1], args[0], core.Version(after)); err != nil {
+				return
+			}
+			defer iterator.Close()
+
+			encoder := json.NewEncoder(cmd.OutOrStdout())
+			for iterator.Next() {
+				var event core.Event
+				if event, err = iterator.Value(); err != nil {
+					return
+				}
+				if err = encoder.Encode(eventstore.NewJSONEvent(&event)); err != nil {
+					return
+				}
+			}
+			return
+		},
+	}
+	ret.Flags().Uint64Var(&after, "after", 0, "show the events after this version")
+	return ret
+}
+
+func newTailCommand(store *eventstore.Store) *cobra.Command {
+	var after uint64
+	var follow bool
+	var interval time.Duration
+	ret := &cobra.Command{
+		Use:   "tail",
+		Short: "Print the global event stream as JSON lines",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			ctx := commandContext(cmd)
+			encoder := json.NewEncoder(cmd.OutOrStdout())
+			fetch := store.All(ctx, core.Version(after), DefaultBatchSize)
+			for {
+				if err = printAll(encoder, fetch); err != nil || !follow {
+					return
+				}
+
+				// other processes append to the store, so poll for new events
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(interval):
+				}
+			}
+		},
+	}
+	ret.Flags().Uint64Var(&after, "after", 0, "print the events after this global version")
+	ret.Flags().BoolVarP(&follow, "follow", "f", false, "wait for new events")
+	ret.Flags().DurationVar(&interval, "interval", DefaultFollowInterval, "poll interval when following")
+	return ret
+}
+
+// printAll prints the batches of the fetcher until it has caught up with the store
+func printAll(encoder *json.Encoder, fetch eventstore.Fetcher) (err error) {
+	for count := -1; count != 0; {
+		if count, err = printBatch(encoder, fetch); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func printBatch(encoder *json.Encoder, fetch eventstore.Fetcher) (count int, err error) {
+	var iterator core.Iterator
+	if iterator, err = fetch(); err != nil {
+		return
+	}
+	defer iterator.Close()
+
+	for iterator.Next() {
+		var event core.Event
+		if event, err = iterator.Value(); err != nil {
+			return
+		}
+		if err = encoder.Encode(eventstore.NewJSONEvent(&event)); err != nil {
+			return
+		}
+		count++
+	}
+	return
+}
+
+func newCountCommand(store *eventstore.Store) *cobra.Command {
+	return &cobra.Command{
+		Use:   "count [aggType]",
+		Short: "Count the events per aggregate type",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			var aggTypes map[string]string
+			if aggTypes, err = store.AggregateTypes.FindAll(); err != nil {
+				return
+			}
+
+			var total int64
+			for _, aggType := range sortedKeys(aggTypes) {
+				if len(args) > 0 && args[0] != aggType {
+					continue
+				}
+
+				var aggregate *eventstore.Aggregate
+				if aggregate, err = store.GetOrCreateForAggType(aggType); err != nil {
+					return
+				}
+
+				var count int64
+				if count, err = aggregate.CountEvents(); err != nil {
+					return
+				}
+				total += count
+				fmt.Fprintf(cmd.OutOrStdout(), "%v\t%d\n", aggType, count)
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "total\t%d\n", total)
+			return
+		},
+	}
+}
+
+func newExportCommand(store *eventstore.Store) *cobra.Command {
+	var selection eventstore.ExportSelection
+	var after, to uint64
+	var file string
+	ret := &cobra.Command{
+		Use:   "export",
+		Short: "Export events as JSON lines, globally, per aggregate type or per aggregate",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			out := cmd.OutOrStdout()
+			if file != "" {
+				var f *os.File
+				if f, err = os.Create(file); err != nil {
+					return
+				}
+				defer func() {
+					if closeErr := f.Close(); err == nil {
+						err = closeErr
+					}
+				}()
+				out = f
+			}
+
+			selection.AfterGlobalVersion = core.Version(after)
+			selection.ToGlobalVersion = core.Version(to)
+
+			var count int
+			if count, err = store.Export(commandContext(cmd), out, selection); err != nil {
+				return
+			}
+			if file != "" {
+				fmt.Fprintf(cmd.OutOrStdout(), "exported %d events\n", count)
+			}
+			return
+		},
+	}
+	ret.Flags().StringVar(&selection.AggregateType, "type", "", "export the events of this aggregate type")
+	ret.Flags().StringVar(&selection.AggregateID, "id", "", "export the events of this aggregate, needs --type")
+	ret.Flags().Uint64Var(&after, "after", 0, "export the events after this global version")
+	ret.Flags().Uint64Var(&to, "to", 0, "export the events up to this global version, 0 means all")
+	ret.Flags().StringVarP(&file, "file", "o", "", "output file, stdout if not set")
+	return ret
+}
+
+func newImportCommand(store *eventstore.Store) *cobra.Command {
+	var options eventstore.ImportOptions
+	var file string
+	ret := &cobra.Command{
+		Use:   "import",
+		Short: "Import exported JSON lines, preserving version and global version",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			in := cmd.InOrStdin()
+			if file != "" {
+				var f *os.File
+				if f, err = os.Open(file); err != nil {
+					return
+				}
+				defer f.Close()
+				in = f
+			}
+
+			var result *eventstore.ImportResult
+			if result, err = store.Import(commandContext(cmd), in, options); err != nil {
+				return
+			}
+
+			verb := "imported"
+			if options.DryRun {
+				verb = "verified"
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "%v %d events\n", verb, result.Count)
+			if result.Count > 0 {
+				fmt.Fprintf(cmd.OutOrStdout(), "global versions %d - %d\n",
+					result.FirstGlobalVersion, result.LastGlobalVersion)
+				for _, aggType := range sortedKeys(result.AggregateTypes) {
+					fmt.Fprintf(cmd.OutOrStdout(), "%v\t%d\n", aggType, result.AggregateTypes[aggType])
+				}
+			}
+			return
+		},
+	}
+	ret.Flags().BoolVar(&options.DryRun, "dry-run", false, "verify the import and roll it back")
+	ret.Flags().StringVarP(&file, "file", "i", "", "input file, stdin if not set")
+	return ret
+}
+
+func newShredCommand(store *eventstore.Store) *cobra.Command {
+	return &cobra.Command{
+		Use:   "shred <aggType> <aggId>",
+		Short: "Destroy the key of an aggregate, its events are redacted afterwards",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			if store.Keys == nil {
+				err = fmt.Errorf("the event store is not encrypted")
+				return
+			}
+			if err = store.Keys.Destroy(args[0], args[1]); err != nil {
+				return
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "destroyed the key of %v %v\n", args[0], args[1])
+			return
+		},
+	}
+}
+
+func newMigrateStorageCommand(store *eventstore.Store) *cobra.Command {
+	return &cobra.Command{
+		Use:   "migrate-storage <per-type|single>",
+		Short: "Copy all events into the storage layout, the former collections are kept",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			var storage eventstore.Storage
+			if storage, err = eventstore.ParseStorage(args[0]); err != nil {
+				return
+			}
+
+			var count int
+			if count, err = store.MigrateStorage(commandContext(cmd), storage); err != nil {
+				return
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "copied %d events from the %v into the %v storage\n",
+				count, store.Storage, storage)
+			return
+		},
+	}
+}
+
+func commandContext(cmd *cobra.Command) (ret context.Context) {
+	if ret = cmd.Context(); ret == nil {
+		ret = context.Background()
+	}
+	return
+}
+
+func sortedKeys[V any](values map[string]V) (ret []string) {
+	for key := range values {
+		ret = append(ret, key)
+	}
+	sort.Strings(ret)
+	return
+}
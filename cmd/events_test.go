@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-ee/eventsoutcing_pocketbase/eventstore"
+	"github.com/go-ee/eventsoutcing_pocketbase/internal/testapp"
+	"github.com/hallgren/eventsourcing/core"
+)
+
+func TestEventsCommand(t *testing.T) {
+	source := newTestStore(t)
+	for i, aggType := range []string{"Person", "Order", "Person"} {
+		err := source.Save([]core.Event{{
+			AggregateID:   string(rune('a' + i)),
+			AggregateType: aggType,
+			Version:       1,
+			Timestamp:     time.Now(),
+			Reason:        "Created",
+			Data:          []byte(`{"name":"test"}`),
+			Metadata:      []byte(`{"test":"hello"}`),
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if out := run(t, source, nil, "types"); out != "Order\torder\nPerson\tperson\n" {
+		t.Fatalf("unexpected types: %q", out)
+	}
+	if out := run(t, source, nil, "count", "Person"); out != "Person\t2\ntotal\t2\n" {
+		t.Fatalf("unexpected count: %q", out)
+	}
+	if out := run(t, source, nil, "sequence"); !strings.HasSuffix(out, "\t3\n") {
+		t.Fatalf("unexpected sequence: %q", out)
+	}
+	if out := run(t, source, nil, "sequence", "reserve", "orders", "2"); out != "orders\t1\t2\n" {
+		t.Fatalf("unexpected reserve: %q", out)
+	}
+	if out := run(t, source, nil, "sequence", "list"); !strings.Contains(out, "orders\t2\n") {
+		t.Fatalf("unexpected sequences: %q", out)
+	}
+	deleteGlobal := NewEventsCommand(source)
+	deleteGlobal.SetOut(&bytes.Buffer{})
+	deleteGlobal.SetArgs([]string{"sequence", "delete", eventstore.GlobalVersionSequence})
+	if err := deleteGlobal.Execute(); !errors.Is(err, eventstore.ErrSequenceInUse) {
+		t.Fatalf("expected the global version sequence in use, got %v", err)
+	}
+
+	exported := run(t, source, nil, "export")
+	if lines := strings.Count(exported, "\n"); lines != 3 {
+		t.Fatalf("expected 3 exported events, got %d", lines)
+	}
+
+	target := newTestStore(t)
+	if out := run(t, target, strings.NewReader(exported), "import"); !strings.HasPrefix(out, "imported 3 events\n") {
+		t.Fatalf("unexpected import: %q", out)
+	}
+	if out := run(t, target, nil, "show", "Person", "c"); !strings.Contains(out, `"aggregateId":"c"`) {
+		t.Fatalf("unexpected show: %q", out)
+	}
+}
+
+func run(t *testing.T, store *eventstore.Store, in *strings.Reader, args ...string) string {
+	t.Helper()
+	command := NewEventsCommand(store)
+	out := &bytes.Buffer{}
+	command.SetOut(out)
+	if in != nil {
+		command.SetIn(in)
+	}
+	command.SetArgs(args)
+	if err := command.Execute(); err != nil {
+		t.Fatalf("%v: %v", args, err)
+	}
+	return out.String()
+}
+
+func newTestStore(t *testing.T) (store *eventstore.Store) {
+	t.Helper()
+	appInst, user := testapp.New(t)
+	store = eventstore.New(user, testapp.AuthRoles, appInst)
+	if err := store.Load(); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
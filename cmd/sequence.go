@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/go-ee/eventsoutcing_pocketbase/eventstore"
+	"github.com/spf13/cobra"
+)
+
+// newSequenceCommand prints a sequence, the global version sequence by default, and groups the sequence operations
+func newSequenceCommand(store *eventstore.Store) (ret *cobra.Command) {
+	ret = &cobra.Command{
+		Use:   "sequence [name]",
+		Short: "Print the current value of a sequence, by default of the global version sequence",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			name := eventstore.GlobalVersionSequence
+			if len(args) > 0 {
+				name = args[0]
+			}
+
+			var current int
+			if current, err = store.Sequence.Current(name); err != nil {
+				return
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "%v\t%d\n", name, current)
+			return
+		},
+	}
+
+	ret.AddCommand(
+		&cobra.Command{
+			Use:   "list",
+			Short: "List all sequences with their current values",
+			Args:  cobra.NoArgs,
+			RunE: func(cmd *cobra.Command, args []string) (err error) {
+				var sequences map[string]int
+				if sequences, err = store.Sequence.List(); err != nil {
+					return
+				}
+				for _, name := range sortedKeys(sequences) {
+					fmt.Fprintf(cmd.OutOrStdout(), "%v\t%d\n", name, sequences[name])
+				}
+				return
+			},
+		},
+		&cobra.Command{
+			Use:   "set <name> <value>",
+			Short: "Set a sequence forward to the value, e.g. to repair it after a restore",
+			Args:  cobra.ExactArgs(2),
+			RunE: func(cmd *cobra.Command, args []string) (err error) {
+				var value int
+				if value, err = strconv.Atoi(args[1]); err != nil {
+					return
+				}
+				if err = store.SetSequence(args[0], value); err != nil {
+					return
+				}
+				fmt.Fprintf(cmd.OutOrStdout(), "%v\t%d\n", args[0], value)
+				return
+			},
+		},
+		&cobra.Command{
+			Use:   "reserve <name> <count>",
+			Short: "Reserve a range of values of a sequence",
+			Args:  cobra.ExactArgs(2),
+			RunE: func(cmd *cobra.Command, args []string) (err error) {
+				var count int
+				if count, err = strconv.Atoi(args[1]); err != nil {
+					return
+				}
+
+				var first, last int
+				if first, last, err = store.Sequence.Reserve(args[0], count); err != nil {
+					return
+				}
+				fmt.Fprintf(cmd.OutOrStdout(), "%v\t%d\t%d\n", args[0], first, last)
+				return
+			},
+		},
+		&cobra.Command{
+			Use:   "delete <name>",
+			Short: "Delete a sequence, it starts again at 1, the global version sequence only without events",
+			Args:  cobra.ExactArgs(1),
+			RunE: func(cmd *cobra.Command, args []string) (err error) {
+				if err = store.DeleteSequence(commandContext(cmd), args[0]); err != nil {
+					return
+				}
+				fmt.Fprintf(cmd.OutOrStdout(), "deleted %v\n", args[0])
+				return
+			},
+		},
+	)
+	return
+}
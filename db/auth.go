@@ -27,6 +27,15 @@ func NewAuth(collectionName string, fieldKey string, user *User, roles []string,
 	}
 }
 
+// NewScopedAuth creates the authorization of a collection shared by several scopes, e.g. aggregate types.
+// The auth records are keyed by the scope and the key, so a record grants access within its scope only.
+func NewScopedAuth(collectionName string, fieldScope string, fieldKey string, user *User, roles []string, env Env) (ret Auth) {
+	ret = NewAuth(collectionName, fieldKey, user, roles, env)
+	ret.AuthBuilder.FieldScope = fieldScope
+	ret.AuthBuilder.Init()
+	return
+}
+
 type Auth struct {
 	CollectionBase
 	CollectionAuth CollectionBase
@@ -58,8 +67,13 @@ func (auth *Auth) Load() (err error) {
 				Required: true,
 			},
 		)
-		auth.CollectionAuth.Collection.AddIndex(fmt.Sprintf("idx_%v_%v",
-			auth.AuthBuilder.CollectionName, auth.AuthBuilder.FieldKey), true, auth.AuthBuilder.FieldKey, "")
+		if auth.AuthBuilder.FieldScope != "" {
+			auth.CollectionAuth.Collection.Fields.Add(&core.TextField{
+				Name:     auth.AuthBuilder.FieldScope,
+				Required: true,
+			})
+		}
+		auth.CollectionAuth.Collection.AddIndex(auth.AuthBuilder.keyIndexName(), true, auth.AuthBuilder.keyIndexColumns(), "")
 
 		for _, role := range auth.AuthBuilder.Roles {
 
@@ -73,6 +87,26 @@ func (auth *Auth) Load() (err error) {
 		}
 
 		err = dao.Save(auth.CollectionAuth.Collection)
+	} else if err == nil {
+		err = auth.migrate()
+	}
+	return
+}
+
+// migrate keys an auth collection of an older version by the scope.
+// Its records have no scope, they grant no access until the scope is set.
+func (auth *Auth) migrate() (err error) {
+	builder := auth.AuthBuilder
+	coll := auth.CollectionAuth.Collection
+	if builder.FieldScope == "" || coll.Fields.GetByName(builder.FieldScope) != nil {
+		return
+	}
+
+	coll.Fields.Add(&core.TextField{Name: builder.FieldScope, Required: true})
+	coll.RemoveIndex(fmt.Sprintf("idx_%v_%v", builder.CollectionName, builder.FieldKey))
+	coll.AddIndex(builder.keyIndexName(), true, builder.keyIndexColumns(), "")
+	if err = auth.App().Save(coll); err != nil {
+		err = fmt.Errorf("migrate the collection %v: %w", coll.Name, err)
 	}
 	return
 }
@@ -130,6 +164,11 @@ func NewAuthorizationBuilder(collectionName string, fieldKey string, roles []str
 type AuthorizationBuilder struct {
 	CollectionName string
 	FieldKey       string
+	// FieldScope is the scope of the key in a shared collection, e.g. the aggregate type, empty if not scoped
+	FieldScope string
+	// Scope is compared with the FieldScope of the auth records instead of the FieldScope of the record,
+	// for a collection of one scope without the field, see ForScope
+	Scope string
 
 	CollectionUsers           string
 	CollectionUsersFieldAdmin string
@@ -148,6 +187,43 @@ func (o *AuthorizationBuilder) Init() {
 	o.AuthGlobalAdmin = AuthGlobalAdmin(o.CollectionUsersFieldAdmin)
 	o.AuthLoggedIn = "@request.auth.id != \"\""
 	o.authCollectionKeyIn = fmt.Sprintf("%v ?= @collection.%v.%v", o.FieldKey, o.CollectionName, o.FieldKey)
+	// the conditions on @collection share one join, so the scope, the key and the roles match the same auth record
+	if o.FieldScope != "" && o.Scope != "" {
+		o.authCollectionKeyIn += fmt.Sprintf(" && @collection.%v.%v ?= %q", o.CollectionName, o.FieldScope, o.Scope)
+	} else if o.FieldScope != "" {
+		o.authCollectionKeyIn += fmt.Sprintf(" && %v ?= @collection.%v.%v", o.FieldScope, o.CollectionName, o.FieldScope)
+	}
+}
+
+// ForScope returns the builder for a collection of the scope without the scope field, e.g. the snapshots
+// of an aggregate type. A builder without FieldScope is returned as copy.
+func (o *AuthorizationBuilder) ForScope(scope string) (ret *AuthorizationBuilder) {
+	copied := *o
+	ret = &copied
+	ret.Scope = scope
+	ret.Init()
+	return
+}
+
+// HasScopedRules returns true, if the rules of the collection apply the scope, are not based on the auth records
+// or the builder is not scoped
+func (o *AuthorizationBuilder) HasScopedRules(coll *core.Collection) bool {
+	return o.FieldScope == "" || coll.ListRule == nil || *coll.ListRule == "" ||
+		strings.Contains(*coll.ListRule, o.authCollectionKeyIn)
+}
+
+func (o *AuthorizationBuilder) keyIndexName() string {
+	if o.FieldScope != "" {
+		return fmt.Sprintf("idx_%v_%v_%v", o.CollectionName, o.FieldScope, o.FieldKey)
+	}
+	return fmt.Sprintf("idx_%v_%v", o.CollectionName, o.FieldKey)
+}
+
+func (o *AuthorizationBuilder) keyIndexColumns() string {
+	if o.FieldScope != "" {
+		return fmt.Sprintf("%v, %v", o.FieldScope, o.FieldKey)
+	}
+	return o.FieldKey
 }
 
 func (o *AuthorizationBuilder) ListRule() string {
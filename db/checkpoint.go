@@ -0,0 +1,104 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"time"
+)
+
+const (
+	CheckpointColName = "checkpoint"
+	FieldVersion      = "version"
+)
+
+func NewCheckpoints(env Env) *Checkpoints {
+	return &Checkpoints{
+		CollectionBase: CollectionBase{Name: CheckpointColName, Env: env},
+	}
+}
+
+// Checkpoints persists the last processed global version per projection name
+type Checkpoints struct {
+	CollectionBase
+}
+
+func (c *Checkpoints) Load() (err error) {
+	if c.Collection != nil && !c.IsRecreateDb() {
+		return
+	}
+
+	dao := c.App()
+	if c.Collection, err = dao.FindCollectionByNameOrId(c.Name); c.Collection == nil || c.IsRecreateDb() {
+		if c.Collection != nil {
+			if err = dao.Delete(c.Collection); err != nil {
+				return
+			}
+		}
+
+		c.Collection = core.NewBaseCollection(c.Name)
+		c.Collection.Fields.Add(
+			&core.TextField{
+				Name:     FieldName,
+				Required: true,
+			},
+			&core.NumberField{
+				Name: FieldVersion,
+				Min:  types.Pointer(0.0),
+			},
+			&core.DateField{
+				Name:     FieldLastUpdated,
+				Required: true,
+			},
+		)
+
+		indexName := fmt.Sprintf("idx_%v_%v", c.Name, FieldName)
+		c.Collection.AddIndex(indexName, true, FieldName, "")
+
+		err = dao.Save(c.Collection)
+	}
+	return
+}
+
+// Get returns the checkpoint of the projection, 0 if it has none yet
+func (c *Checkpoints) Get(name string) (ret int, err error) {
+	var record *core.Record
+	if record, err = c.find(c.App(), name); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = nil
+		}
+		return
+	}
+	ret = record.GetInt(FieldVersion)
+	return
+}
+
+func (c *Checkpoints) Set(name string, version int) (err error) {
+	err = c.App().RunInTransaction(func(txApp core.App) error {
+		return c.SetTx(txApp, name, version)
+	})
+	return
+}
+
+func (c *Checkpoints) SetTx(txApp core.App, name string, version int) (err error) {
+	var record *core.Record
+	if record, err = c.find(txApp, name); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return
+		}
+		record = core.NewRecord(c.Collection)
+		record.Set(FieldName, name)
+	}
+
+	record.Set(FieldVersion, version)
+	record.Set(FieldLastUpdated, time.Now())
+	err = txApp.Save(record)
+	return
+}
+
+func (c *Checkpoints) find(app core.App, name string) (*core.Record, error) {
+	return app.FindFirstRecordByFilter(c.Name, "name = {:name}", dbx.Params{"name": name})
+}
@@ -24,3 +24,9 @@ type Env interface {
 	IsRecreateDbAuth() bool
 	IsAuthDisabled() bool
 }
+
+// MasterKeyEnv is an Env supplying the 32 byte master key, which wraps the data keys of the encryption
+type MasterKeyEnv interface {
+	Env
+	MasterKey() []byte
+}
@@ -0,0 +1,27 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// RunInReadTransaction runs fn in a read-only transaction on the concurrent connections of the app,
+// so all its queries see the same state of the database without blocking the writers.
+// Within a transaction of the app, fn runs as part of it.
+func RunInReadTransaction(ctx context.Context, app core.App, fn func(tx dbx.Builder) error) (err error) {
+	switch builder := app.ConcurrentDB().(type) {
+	case *dbx.Tx:
+		err = fn(builder)
+	case *dbx.DB:
+		err = builder.TransactionalContext(ctx, &sql.TxOptions{ReadOnly: true}, func(tx *dbx.Tx) error {
+			return fn(tx)
+		})
+	default:
+		err = fmt.Errorf("failed to start a read transaction (unknown db type %T)", builder)
+	}
+	return
+}
@@ -0,0 +1,122 @@
+package db
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+const DefaultSequenceBlockSize = 100
+
+func NewSequenceBlocks(sequence *Sequence, blockSize int) *SequenceBlocks {
+	if blockSize <= 0 {
+		blockSize = DefaultSequenceBlockSize
+	}
+	return &SequenceBlocks{
+		Sequence:  sequence,
+		BlockSize: blockSize,
+		blocks:    map[string]*sequenceBlock{},
+	}
+}
+
+// SequenceBlocks allocates the values of a Sequence from blocks reserved ahead of use (hi/lo).
+// Only the reservation of a block writes the sequence record, the values of a block are handed out from memory.
+//
+// The values are unique, but not gapless and not committed in ascending order:
+//   - the values of a block not used until the process ends are skipped
+//   - the values handed to a rolled back transaction are skipped
+//   - concurrent writers, also of other processes, commit their values in any order,
+//     so a reader following the sequence may see a lower value after a higher one.
+//
+// A block reserved by a rolled back transaction is discarded, so no value is handed out twice.
+// Use the Sequence itself, where gapless values are required.
+type SequenceBlocks struct {
+	Sequence  *Sequence
+	BlockSize int
+
+	mu     sync.Mutex
+	blocks map[string]*sequenceBlock
+}
+
+// sequenceBlock is the not yet handed out range of a reserved block
+type sequenceBlock struct {
+	next int
+	last int
+}
+
+func (o *SequenceBlocks) GetNextMultiple(sequenceName string, count int) (ret []int, err error) {
+	err = o.Sequence.App().RunInTransaction(func(txApp core.App) (txErr error) {
+		ret, txErr = o.GetNextMultipleTx(txApp, sequenceName, count)
+		return
+	})
+	return
+}
+
+// GetNextMultipleTx hands out the values from the current block or reserves a new block within the transaction.
+// A new block is used by other calls only after the transaction is committed.
+func (o *SequenceBlocks) GetNextMultipleTx(txApp core.App, sequenceName string, count int) (ret []int, err error) {
+	if count <= 0 {
+		err = fmt.Errorf("count must be positive")
+		return
+	}
+
+	if ret = o.take(sequenceName, count); ret != nil {
+		return
+	}
+
+	var first, last int
+	if first, last, err = o.Sequence.ReserveTx(txApp, sequenceName, max(o.BlockSize, count)); err != nil {
+		return
+	}
+
+	ret = make([]int, count)
+	for i := range ret {
+		ret[i] = first + i
+	}
+
+	rest := &sequenceBlock{next: first + count, last: last}
+	if txInfo := txApp.TxInfo(); txInfo != nil {
+		txInfo.OnComplete(func(txErr error) error {
+			if txErr == nil {
+				o.activate(sequenceName, rest)
+			}
+			return nil
+		})
+	} else {
+		o.activate(sequenceName, rest)
+	}
+	return
+}
+
+// Reset discards the blocks in memory, their remaining values are skipped
+func (o *SequenceBlocks) Reset() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	clear(o.blocks)
+}
+
+func (o *SequenceBlocks) take(sequenceName string, count int) (ret []int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	block := o.blocks[sequenceName]
+	if block == nil || block.last-block.next+1 < count {
+		return
+	}
+
+	ret = make([]int, count)
+	for i := range ret {
+		ret[i] = block.next + i
+	}
+	block.next += count
+	return
+}
+
+func (o *SequenceBlocks) activate(sequenceName string, block *sequenceBlock) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if block.next <= block.last {
+		o.blocks[sequenceName] = block
+	}
+}
@@ -2,6 +2,7 @@ package db
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"github.com/pocketbase/dbx"
 	"github.com/pocketbase/pocketbase/core"
@@ -22,6 +23,13 @@ func NewSequence(env Env) *Sequence {
 	}
 }
 
+// SequenceAllocator hands out the next values of a sequence within a transaction
+type SequenceAllocator interface {
+	GetNextMultipleTx(txApp core.App, sequenceName string, count int) ([]int, error)
+}
+
+// Sequence stores the current value of named sequences.
+// Its values are gapless, but every allocation writes the sequence record, see SequenceBlocks.
 type Sequence struct {
 	CollectionBase
 }
@@ -64,27 +72,19 @@ func (s *Sequence) Load() (err error) {
 	return
 }
 
-// Helper to find or create a sequence record
-func (s *Sequence) findOrCreateSequence(txApp core.App, sequenceName string, initialValue int) (
-	record *core.Record, currentValue int, err error) {
+// ErrSequenceBackwards is returned, if a sequence would be set below its current value
+var ErrSequenceBackwards = errors.New("sequence must not move backwards")
 
+// findSequence returns the record of the sequence and its current value,
+// a new not yet saved record with the value 0 if the sequence does not exist.
+func (s *Sequence) findSequence(txApp core.App, sequenceName string) (record *core.Record, currentValue int, err error) {
 	if record, err = txApp.FindFirstRecordByFilter(
 		s.Name, "name = {:name}", dbx.Params{"name": sequenceName},
 	); err != nil {
-		if err == sql.ErrNoRows {
+		if errors.Is(err, sql.ErrNoRows) {
 			record = core.NewRecord(s.Collection)
 			record.Set(FieldName, sequenceName)
-			record.Set(FieldCurrentValue, initialValue)
-			record.Set(FieldLastUpdated, time.Now())
-
-			if err = txApp.Save(record); err != nil {
-				return
-			}
-
-			currentValue = initialValue
 			err = nil
-
-			return
 		}
 		return
 	}
@@ -92,6 +92,81 @@ func (s *Sequence) findOrCreateSequence(txApp core.App, sequenceName string, ini
 	return
 }
 
+func (s *Sequence) saveValue(txApp core.App, record *core.Record, value int) (err error) {
+	record.Set(FieldCurrentValue, value)
+	record.Set(FieldLastUpdated, time.Now())
+	err = txApp.Save(record)
+	return
+}
+
+// Current returns the current value of the sequence, 0 if it does not exist yet
+func (s *Sequence) Current(sequenceName string) (ret int, err error) {
+	ret, err = s.CurrentTx(s.App(), sequenceName)
+	return
+}
+
+func (s *Sequence) CurrentTx(txApp core.App, sequenceName string) (ret int, err error) {
+	_, ret, err = s.findSequence(txApp, sequenceName)
+	return
+}
+
+// List returns the current values of all sequences, keyed by name
+func (s *Sequence) List() (ret map[string]int, err error) {
+	var records []*core.Record
+	if records, err = s.App().FindAllRecords(s.Collection); err != nil {
+		return
+	}
+
+	ret = make(map[string]int, len(records))
+	for _, record := range records {
+		ret[record.GetString(FieldName)] = record.GetInt(FieldCurrentValue)
+	}
+	return
+}
+
+// Set sets the current value of the sequence, e.g. to repair it after a restore.
+// The value must not be below the current value, otherwise ErrSequenceBackwards is returned.
+func (s *Sequence) Set(sequenceName string, value int) (err error) {
+	err = s.App().RunInTransaction(func(txApp core.App) error {
+		return s.SetTx(txApp, sequenceName, value)
+	})
+	return
+}
+
+func (s *Sequence) SetTx(txApp core.App, sequenceName string, value int) (err error) {
+	var sequence *core.Record
+	var currentVal int
+	if sequence, currentVal, err = s.findSequence(txApp, sequenceName); err != nil {
+		return
+	}
+
+	if value < currentVal {
+		err = fmt.Errorf("%w: %v is at %d, requested %d", ErrSequenceBackwards, sequenceName, currentVal, value)
+		return
+	}
+	if value > currentVal {
+		err = s.saveValue(txApp, sequence, value)
+	}
+	return
+}
+
+// Delete removes the sequence, it starts again at 1. A missing sequence is ignored.
+func (s *Sequence) Delete(sequenceName string) (err error) {
+	err = s.App().RunInTransaction(func(txApp core.App) error {
+		return s.DeleteTx(txApp, sequenceName)
+	})
+	return
+}
+
+func (s *Sequence) DeleteTx(txApp core.App, sequenceName string) (err error) {
+	var sequence *core.Record
+	if sequence, _, err = s.findSequence(txApp, sequenceName); err != nil || sequence.IsNew() {
+		return
+	}
+	err = txApp.Delete(sequence)
+	return
+}
+
 func (s *Sequence) GetNext(sequenceName string) (ret int, err error) {
 	err = s.App().RunInTransaction(func(txApp core.App) (txErr error) {
 		ret, txErr = s.GetNextTx(txApp, sequenceName)
@@ -108,25 +183,35 @@ func (s *Sequence) GetNextMultiple(sequenceName string, count int) (ret []int, e
 	return
 }
 
+// GetNextTx returns the next value of the sequence, a new sequence starts at 1
 func (s *Sequence) GetNextTx(txApp core.App, sequenceName string) (ret int, err error) {
-	var sequence *core.Record
-	var currentVal int
-	if sequence, currentVal, err = s.findOrCreateSequence(txApp, sequenceName, 1); err != nil {
+	ret, _, err = s.ReserveTx(txApp, sequenceName, 1)
+	return
+}
+
+func (s *Sequence) GetNextMultipleTx(txApp core.App, sequenceName string, count int) (ret []int, err error) {
+	var first int
+	if first, _, err = s.ReserveTx(txApp, sequenceName, count); err != nil {
 		return
 	}
 
-	if currentVal == 1 && sequence.GetInt(FieldCurrentValue) == 1 {
-		ret = 1
-	} else {
-		ret = currentVal + 1
-		sequence.Set(FieldCurrentValue, ret)
-		sequence.Set(FieldLastUpdated, time.Now())
-		err = txApp.Save(sequence)
+	ret = make([]int, count)
+	for i := 0; i < count; i++ {
+		ret[i] = first + i
 	}
 	return
 }
 
-func (s *Sequence) GetNextMultipleTx(txApp core.App, sequenceName string, count int) (ret []int, err error) {
+// Reserve moves the sequence forward by count and returns the range of the reserved values
+func (s *Sequence) Reserve(sequenceName string, count int) (first int, last int, err error) {
+	err = s.App().RunInTransaction(func(txApp core.App) (txErr error) {
+		first, last, txErr = s.ReserveTx(txApp, sequenceName, count)
+		return
+	})
+	return
+}
+
+func (s *Sequence) ReserveTx(txApp core.App, sequenceName string, count int) (first int, last int, err error) {
 	if count <= 0 {
 		err = fmt.Errorf("count must be positive")
 		return
@@ -134,25 +219,26 @@ func (s *Sequence) GetNextMultipleTx(txApp core.App, sequenceName string, count
 
 	var sequence *core.Record
 	var currentVal int
-	if sequence, currentVal, err = s.findOrCreateSequence(txApp, sequenceName, count); err != nil {
+	if sequence, currentVal, err = s.findSequence(txApp, sequenceName); err != nil {
 		return
 	}
 
-	var startVal int
-	if currentVal == count && sequence.GetInt(FieldCurrentValue) == count {
-		startVal = 1
-	} else {
-		startVal = currentVal + 1
-		sequence.Set(FieldCurrentValue, currentVal+count)
-		sequence.Set(FieldLastUpdated, time.Now())
-		if err = txApp.Save(sequence); err != nil {
-			return
-		}
+	first = currentVal + 1
+	last = currentVal + count
+	err = s.saveValue(txApp, sequence, last)
+	return
+}
+
+// AdvanceTx moves the sequence forward to the value, a sequence already beyond the value is not changed
+func (s *Sequence) AdvanceTx(txApp core.App, sequenceName string, value int) (err error) {
+	var sequence *core.Record
+	var currentVal int
+	if sequence, currentVal, err = s.findSequence(txApp, sequenceName); err != nil {
+		return
 	}
 
-	ret = make([]int, count)
-	for i := 0; i < count; i++ {
-		ret[i] = startVal + i
+	if currentVal < value {
+		err = s.saveValue(txApp, sequence, value)
 	}
 	return
 }
@@ -0,0 +1,192 @@
+package eventstore
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-ee/eventsoutcing_pocketbase/db"
+	"github.com/pocketbase/dbx"
+
+	pbcore "github.com/pocketbase/pocketbase/core"
+)
+
+const AggTypesColName = "aggregate_types"
+const AggTypesFieldName = "name"
+const AggTypesFieldCollection = "collection"
+
+func NewAggregateTypes(env db.Env) *AggregateTypes {
+	return &AggregateTypes{
+		CollectionBase: db.CollectionBase{Name: AggTypesColName, Env: env},
+	}
+}
+
+// AggregateTypes keeps track of all aggregate types and their collections,
+// so the event collections can be found without knowing the types in advance.
+type AggregateTypes struct {
+	db.CollectionBase
+}
+
+func (o *AggregateTypes) Load() (err error) {
+	if o.Collection != nil && !o.IsRecreateDb() {
+		return
+	}
+
+	dao := o.App()
+	if o.Collection, err = dao.FindCollectionByNameOrId(o.Name); o.Collection == nil || o.IsRecreateDb() {
+		if o.Collection != nil {
+			if err = dao.Delete(o.Collection); err != nil {
+				return
+			}
+		}
+
+		o.Collection = pbcore.NewBaseCollection(o.Name)
+		o.Collection.Fields.Add(
+			&pbcore.TextField{
+				Name:     AggTypesFieldName,
+				Required: true,
+			},
+			&pbcore.TextField{
+				Name:     AggTypesFieldCollection,
+				Required: true,
+			},
+		)
+
+		indexName := fmt.Sprintf("idx_%v_%v", o.Name, AggTypesFieldName)
+		o.Collection.AddIndex(indexName, true, AggTypesFieldName, "")
+
+		err = dao.Save(o.Collection)
+	}
+	return
+}
+
+// Register stores the aggregate type with its collection name, if not already known.
+// A collection of its own belongs to one aggregate type, so other types registered for it are removed,
+// e.g. the type derived by Backfill.
+func (o *AggregateTypes) Register(aggType string, colName string) (err error) {
+	err = o.RegisterTx(o.App(), aggType, colName)
+	return
+}
+
+func (o *AggregateTypes) RegisterTx(txApp pbcore.App, aggType string, colName string) (err error) {
+	dao := txApp
+
+	var record *pbcore.Record
+	if record, err = dao.FindFirstRecordByFilter(o.Collection.Id,
+		fmt.Sprintf("%v = {:%v}", AggTypesFieldName, AggTypesFieldName),
+		dbx.Params{AggTypesFieldName: aggType},
+	); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return
+	}
+
+	if record != nil && record.GetString(AggTypesFieldCollection) == colName {
+		return
+	}
+
+	if record == nil {
+		record = pbcore.NewRecord(o.Collection)
+		record.Set(AggTypesFieldName, aggType)
+	}
+	record.Set(AggTypesFieldCollection, colName)
+	if err = dao.Save(record); err != nil || colName == EventsColName {
+		return
+	}
+
+	var others []*pbcore.Record
+	if others, err = dao.FindAllRecords(o.Collection,
+		dbx.HashExp{AggTypesFieldCollection: colName},
+		dbx.Not(dbx.HashExp{AggTypesFieldName: aggType}),
+	); err != nil {
+		return
+	}
+	for _, other := range others {
+		if err = dao.Delete(other); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Backfill registers the event collections of the aggregate types saved before the registry existed.
+// The aggregate type is derived from the collection name, a later Register with the actual type replaces it.
+func (o *AggregateTypes) Backfill() (err error) {
+	var registered map[string]string
+	if registered, err = o.FindAll(); err != nil {
+		return
+	}
+	known := map[string]bool{}
+	for _, colName := range registered {
+		known[colName] = true
+	}
+
+	var collections []*pbcore.Collection
+	if collections, err = o.App().FindAllCollections(pbcore.CollectionTypeBase); err != nil {
+		return
+	}
+	for _, collection := range collections {
+		if known[collection.Name] || !isAggregateCollection(collection) {
+			continue
+		}
+		if err = o.Register(aggTypeOfColName(collection.Name), collection.Name); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// isAggregateCollection returns true for the events collection of an aggregate type.
+// The shared events collection and the outbox have the aggregate type field, the snapshots have no reason.
+func isAggregateCollection(collection *pbcore.Collection) bool {
+	for _, field := range []string{AggTypeFieldAggId, AggTypeFieldVersion, AggTypeFieldGlobalVersion,
+		AggTypeFieldReason, AggTypeFieldTimestamp} {
+		if collection.Fields.GetByName(field) == nil {
+			return false
+		}
+	}
+	return collection.Fields.GetByName(AggTypeFieldAggType) == nil
+}
+
+// aggTypeOfColName derives the aggregate type from the snake case collection name, e.g. OrderItem of order_item.
+// The collection name itself is used, if the derived type would not map back to the collection.
+func aggTypeOfColName(colName string) (ret string) {
+	parts := strings.Split(colName, "_")
+	for i, part := range parts {
+		if part != "" {
+			parts[i] = strings.ToUpper(part[:1]) + part[1:]
+		}
+	}
+	if ret = strings.Join(parts, ""); buildAggTypeColName(ret) != colName {
+		ret = colName
+	}
+	return
+}
+
+// FindAll returns the collection names of all registered aggregate types, keyed by aggregate type.
+func (o *AggregateTypes) FindAll() (ret map[string]string, err error) {
+	var records []*pbcore.Record
+	if records, err = o.App().FindAllRecords(o.Collection.Id); err != nil {
+		return
+	}
+
+	ret = make(map[string]string, len(records))
+	for _, record := range records {
+		ret[record.GetString(AggTypesFieldName)] = record.GetString(AggTypesFieldCollection)
+	}
+	return
+}
+
+// Exists returns true, if the aggregate type is registered
+func (o *AggregateTypes) Exists(aggType string) (ret bool, err error) {
+	if _, err = o.App().FindFirstRecordByFilter(o.Collection.Id,
+		fmt.Sprintf("%v = {:%v}", AggTypesFieldName, AggTypesFieldName),
+		dbx.Params{AggTypesFieldName: aggType},
+	); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = nil
+		}
+		return
+	}
+	ret = true
+	return
+}
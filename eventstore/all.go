@@ -0,0 +1,126 @@
+package eventstore
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/hallgren/eventsourcing/core"
+	"github.com/pocketbase/dbx"
+)
+
+// QueryFilter restricts the records read from the collection of an aggregate type
+type QueryFilter func(aggregate *Aggregate, query *dbx.SelectQuery) error
+
+// Fetcher returns the next batch of events on every call, it has the same shape as hallgren's core.Fetcher.
+// An iterator without events means the fetcher has caught up with the store.
+type Fetcher func() (core.Iterator, error)
+
+// All returns a fetcher over the events of all aggregate types in global_version order,
+// starting after afterGlobalVersion and reading at most batchSize events per call (0 means no limit).
+func (store *Store) All(ctx context.Context, afterGlobalVersion core.Version, batchSize uint64) Fetcher {
+	return store.AllFiltered(ctx, afterGlobalVersion, batchSize, nil)
+}
+
+// AllFiltered is All with a filter applied to the collection of each aggregate type
+func (store *Store) AllFiltered(
+	ctx context.Context, afterGlobalVersion core.Version, batchSize uint64, filter QueryFilter) Fetcher {
+
+	return func() (ret core.Iterator, err error) {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+
+		var events []core.Event
+		if events, err = store.FindAfterGlobalVersion(ctx, afterGlobalVersion, batchSize, filter); err != nil {
+			return
+		}
+
+		if len(events) > 0 {
+			afterGlobalVersion = events[len(events)-1].GlobalVersion
+		}
+		ret = NewEventsIterator(events)
+		return
+	}
+}
+
+// FindAfterGlobalVersion merges the events of all registered aggregate types after the given global version.
+// The filter is optional.
+func (store *Store) FindAfterGlobalVersion(
+	ctx context.Context, afterGlobalVersion core.Version, limit uint64, filter QueryFilter) (ret []core.Event, err error) {
+
+	var aggregates []*Aggregate
+	if aggregates, err = store.aggregates(); err != nil {
+		return
+	}
+
+	for _, aggregate := range aggregates {
+		var events []core.Event
+		if events, err = aggregate.FindAfterGlobalVersion(ctx, afterGlobalVersion, limit, filter); err != nil {
+			return
+		}
+		ret = append(ret, events...)
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].GlobalVersion < ret[j].GlobalVersion
+	})
+
+	if limit > 0 && uint64(len(ret)) > limit {
+		ret = ret[:limit]
+	}
+	return
+}
+
+// FindAfterGlobalVersion returns the events of the aggregate type after the given global version.
+// The filter is optional.
+func (o *Aggregate) FindAfterGlobalVersion(
+	ctx context.Context, afterGlobalVersion core.Version, limit uint64, filter QueryFilter) (ret []core.Event, err error) {
+
+	query := o.eventQuery(o.App()).
+		WithContext(ctx).
+		AndWhere(dbx.NewExp(fmt.Sprintf("%v > {:%v}", AggTypeFieldGlobalVersion, AggTypeFieldGlobalVersion),
+			dbx.Params{AggTypeFieldGlobalVersion: uint64(afterGlobalVersion)})).
+		OrderBy(AggTypeFieldGlobalVersion + " ASC")
+	if limit > 0 {
+		query.Limit(int64(limit))
+	}
+	if filter != nil {
+		if err = filter(o, query); err != nil {
+			return
+		}
+	}
+
+	ret, err = o.queryEvents(query)
+	return
+}
+
+func NewEventsIterator(events []core.Event) *EventsIterator {
+	return &EventsIterator{
+		events:       events,
+		currentIndex: -1,
+	}
+}
+
+// EventsIterator iterates over already loaded events
+type EventsIterator struct {
+	events       []core.Event
+	currentIndex int
+}
+
+// Next return true if there are more data
+func (i *EventsIterator) Next() bool {
+	i.currentIndex++
+	return i.currentIndex < len(i.events)
+}
+
+// Value return the event
+func (i *EventsIterator) Value() (ret core.Event, err error) {
+	ret = i.events[i.currentIndex]
+	return
+}
+
+// Close closes the iterator
+func (i *EventsIterator) Close() {
+	i.events = nil
+}
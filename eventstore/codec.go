@@ -0,0 +1,178 @@
+package eventstore
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const CodecGzip = "gzip"
+const CodecDeflate = "deflate"
+
+// codecHeader starts the JSON envelope of an encoded payload, records without it are stored uncompressed
+var codecHeader = []byte(`{"$codec":`)
+
+// Codec compresses the Data and Metadata of events.
+// The name is stored with each encoded payload, so a record can be decoded also after the codec of the store changed.
+// Further codecs, e.g. zstd, are added by RegisterCodec.
+//
+// The encoded payload is stored base64 encoded in a JSON envelope, so it fits into the JSON fields.
+// Base64 adds a third to the compressed size, so a payload is stored encoded only,
+// if it compresses to less than about three quarters. Small payloads are better stored without codec.
+type Codec interface {
+	Name() string
+	Encode(data []byte) ([]byte, error)
+	Decode(data []byte) ([]byte, error)
+}
+
+var codecsMu sync.RWMutex
+var codecs = map[string]Codec{
+	CodecGzip:    &GzipCodec{},
+	CodecDeflate: &DeflateCodec{},
+}
+
+// RegisterCodec makes the codec available for decoding and replaces a codec with the same name
+func RegisterCodec(codec Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[codec.Name()] = codec
+}
+
+func codecByName(name string) (ret Codec, err error) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	if ret = codecs[name]; ret == nil {
+		err = fmt.Errorf("unknown codec %v", name)
+	}
+	return
+}
+
+// GzipCodec compresses with gzip, the zero Level means gzip.DefaultCompression
+type GzipCodec struct {
+	Level int
+}
+
+func (o *GzipCodec) Name() string {
+	return CodecGzip
+}
+
+func (o *GzipCodec) Encode(data []byte) (ret []byte, err error) {
+	level := o.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+
+	var buf bytes.Buffer
+	var writer *gzip.Writer
+	if writer, err = gzip.NewWriterLevel(&buf, level); err != nil {
+		return
+	}
+	if _, err = writer.Write(data); err != nil {
+		return
+	}
+	if err = writer.Close(); err != nil {
+		return
+	}
+	ret = buf.Bytes()
+	return
+}
+
+func (o *GzipCodec) Decode(data []byte) (ret []byte, err error) {
+	var reader *gzip.Reader
+	if reader, err = gzip.NewReader(bytes.NewReader(data)); err != nil {
+		return
+	}
+	defer reader.Close()
+	ret, err = io.ReadAll(reader)
+	return
+}
+
+// DeflateCodec compresses with raw deflate, it saves the header and checksum of gzip.
+// The zero Level means flate.DefaultCompression.
+type DeflateCodec struct {
+	Level int
+}
+
+func (o *DeflateCodec) Name() string {
+	return CodecDeflate
+}
+
+func (o *DeflateCodec) Encode(data []byte) (ret []byte, err error) {
+	level := o.Level
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+
+	var buf bytes.Buffer
+	var writer *flate.Writer
+	if writer, err = flate.NewWriter(&buf, level); err != nil {
+		return
+	}
+	if _, err = writer.Write(data); err != nil {
+		return
+	}
+	if err = writer.Close(); err != nil {
+		return
+	}
+	ret = buf.Bytes()
+	return
+}
+
+func (o *DeflateCodec) Decode(data []byte) (ret []byte, err error) {
+	reader := flate.NewReader(bytes.NewReader(data))
+	defer reader.Close()
+	ret, err = io.ReadAll(reader)
+	return
+}
+
+// encodedPayload is the JSON envelope of an encoded payload, so it fits into the JSON fields
+type encodedPayload struct {
+	Codec   string `json:"$codec"`
+	Payload []byte `json:"payload"`
+}
+
+// encodePayload encodes the data with the codec, if it gets smaller. A nil codec keeps the data as is.
+func encodePayload(codec Codec, data []byte) (ret []byte, err error) {
+	ret = data
+	if codec == nil || len(data) == 0 {
+		return
+	}
+
+	var encoded []byte
+	if encoded, err = codec.Encode(data); err != nil {
+		return
+	}
+
+	var envelope []byte
+	if envelope, err = json.Marshal(encodedPayload{Codec: codec.Name(), Payload: encoded}); err != nil {
+		return
+	}
+	if len(envelope) < len(data) {
+		ret = envelope
+	}
+	return
+}
+
+// decodePayload decodes an encoded payload, other data is returned as is
+func decodePayload(data []byte) (ret []byte, err error) {
+	ret = data
+	if !bytes.HasPrefix(data, codecHeader) {
+		return
+	}
+
+	var envelope encodedPayload
+	if err = json.Unmarshal(data, &envelope); err != nil {
+		return
+	}
+
+	var codec Codec
+	if codec, err = codecByName(envelope.Codec); err != nil {
+		return
+	}
+	ret, err = codec.Decode(envelope.Payload)
+	return
+}
@@ -0,0 +1,47 @@
+package eventstore
+
+import (
+	"encoding/json"
+
+	"github.com/google/uuid"
+	"github.com/hallgren/eventsourcing/core"
+	"github.com/pocketbase/dbx"
+
+	pbcore "github.com/pocketbase/pocketbase/core"
+)
+
+// MetadataKeyEventId is the metadata key of a caller supplied event id.
+// Callers retrying a Save must supply it to make the retry idempotent.
+const MetadataKeyEventId = "event_id"
+
+// EventIdOf returns the event id from the metadata of the event or a new time ordered UUID
+func EventIdOf(event *core.Event) (ret string, err error) {
+	if len(event.Metadata) > 0 {
+		var metadata map[string]any
+		if json.Unmarshal(event.Metadata, &metadata) == nil {
+			if eventId, ok := metadata[MetadataKeyEventId].(string); ok && eventId != "" {
+				ret = eventId
+				return
+			}
+		}
+	}
+
+	var id uuid.UUID
+	if id, err = uuid.NewV7(); err != nil {
+		return
+	}
+	ret = id.String()
+	return
+}
+
+func (o *Aggregate) findByEventIds(txApp pbcore.App, eventIds []string) (ret []*pbcore.Record, err error) {
+	values := make([]any, len(eventIds))
+	for i, eventId := range eventIds {
+		values[i] = eventId
+	}
+
+	err = o.RecordQuery(txApp).
+		AndWhere(dbx.In(AggTypeFieldEventId, values...)).
+		All(&ret)
+	return
+}
@@ -7,14 +7,22 @@ import (
 	"fmt"
 	es "github.com/go-ee/eventsoutcing_pocketbase"
 	"github.com/go-ee/eventsoutcing_pocketbase/db"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
 	"github.com/hallgren/eventsourcing/core"
 	"github.com/pocketbase/dbx"
 	"github.com/pocketbase/pocketbase/tools/types"
+	"golang.org/x/sync/singleflight"
+	"strings"
+	"sync"
 
 	pbcore "github.com/pocketbase/pocketbase/core"
 )
 
-const aggregates_golabl_version = "aggregates_global_version"
+// GlobalVersionSequence is the name of the db.Sequence allocating the global versions of all events
+const GlobalVersionSequence = "aggregates_global_version"
+
+// ErrSequenceInUse is returned when deleting the global version sequence of stored events
+var ErrSequenceInUse = errors.New("the sequence is in use by stored events")
 
 const AggTypeFieldAggId = "agg_id"
 const AggTypeFieldVersion = "version"
@@ -23,29 +31,114 @@ const AggTypeFieldReason = "reason"
 const AggTypeFieldTimestamp = "timestamp"
 const AggTypeFieldData = "data"
 const AggTypeFieldMetadata = "metadata"
+const AggTypeFieldEventId = "event_id"
+
+// AggTypeFieldAggType is the column of the aggregate type in the single collection storage
+const AggTypeFieldAggType = "agg_type"
+
+// EventsColName is the collection of all events in the single collection storage
+const EventsColName = "events"
+
+// Storage is the layout of the event collections
+type Storage int
+
+const (
+	// StorageCollectionPerType stores the events of each aggregate type in an own collection
+	StorageCollectionPerType Storage = iota
+	// StorageSingleCollection stores the events of all aggregate types in the events collection
+	StorageSingleCollection
+)
+
+// PayloadMaxSize is the max stored size of Data and Metadata, with a Codec it applies to the encoded payload
+const PayloadMaxSize = 102400
 
 func New(user *db.User, authRoles []string, env db.Env) *Store {
 	return &Store{
 		CollectionBase: db.CollectionBase{Env: env},
 		User:           user,
 		Sequence:       db.NewSequence(env),
+		AggregateTypes: NewAggregateTypes(env),
 		AuthRoles:      authRoles,
 
 		aggTypeCols: map[string]*Aggregate{},
+		colAggTypes: map[string]string{},
 	}
 }
 
 type Store struct {
 	db.CollectionBase
-	User      *db.User
-	Sequence  *db.Sequence
-	AuthRoles []string
-
+	User           *db.User
+	Sequence       *db.Sequence
+	AggregateTypes *AggregateTypes
+	AuthRoles      []string
+	// Outbox enables the outbox mode, if set each saved event is added to it in the same transaction
+	Outbox *Outbox
+	// Codec enables the compression of Data and Metadata of new events, stored events are readable either way
+	Codec Codec
+	// Keys enables the encryption of the Data of new events with a key per aggregate
+	Keys *Keys
+	// Upcasters transform the Data of old events on read, the schema version of new events is stored in the metadata
+	Upcasters *Upcasters
+	// Storage selects the layout of the event collections, it must be set before Load
+	Storage Storage
+	// GlobalVersions allocates the global versions of new events, nil means the gapless Sequence.
+	// A db.SequenceBlocks avoids the write of the sequence record on every Save, its values may have gaps.
+	// Writers of different processes commit block values out of order, and the readers resuming after a
+	// checkpoint (All, projection.Projection, the SSE feed) would skip events permanently.
+	// Use blocks with such readers only when a single process writes the events.
+	GlobalVersions db.SequenceAllocator
+	// FastPath reads and writes the event rows with plain SQL instead of PocketBase records.
+	// It skips the record hooks, the subscriptions and OnSaved are notified nevertheless.
+	FastPath bool
+
+	// the aggregate types are resolved once and cached, until PocketBase reports a change of their collections
+	mu          sync.RWMutex
+	loads       singleflight.Group
+	hooksOnce   sync.Once
 	aggTypeCols map[string]*Aggregate
+	colAggTypes map[string]string
+
+	saved savedHandlers
 }
 
+// Load prepares the collections of the store, the store is safe for concurrent use afterwards
 func (store *Store) Load() (err error) {
-	err = store.Sequence.Load()
+	store.hooksOnce.Do(store.bindCollectionHooks)
+
+	if err = store.Sequence.Load(); err != nil {
+		return
+	}
+	if err = store.AggregateTypes.Load(); err != nil {
+		return
+	}
+	if store.Storage == StorageCollectionPerType {
+		if err = store.AggregateTypes.Backfill(); err != nil {
+			return
+		}
+	}
+	if store.Keys != nil {
+		if err = store.Keys.Load(); err != nil {
+			return
+		}
+	}
+	if store.Storage == StorageSingleCollection {
+		// the shared collection is created once, before the aggregate types use it concurrently
+		if _, err = store.GetOrCreateForAggType(""); err != nil {
+			return
+		}
+	}
+	if store.Outbox != nil {
+		if store.Outbox.Codec == nil {
+			store.Outbox.Codec = store.Codec
+		}
+		if store.Outbox.Keys == nil {
+			store.Outbox.Keys = store.Keys
+		}
+		if store.Outbox.Upcasters == nil {
+			store.Outbox.Upcasters = store.Upcasters
+		}
+		err = store.Outbox.Load()
+	}
 	return
 }
 
@@ -61,40 +154,228 @@ func (store *Store) Get(
 	return
 }
 
-// Save persists events to the collections for aggregate type
+// Save persists events to the collections for aggregate type.
+// Events of several aggregates are saved atomically like with SaveMulti.
 func (store *Store) Save(events []core.Event) (err error) {
-	// If no event return no error
-	if len(events) == 0 {
+	err = store.SaveMulti(events)
+	return
+}
+
+// SetSequence sets a sequence of the store forward to the value, see db.Sequence.Set.
+// The reserved blocks of the global versions are discarded, they may be below the value.
+func (store *Store) SetSequence(name string, value int) (err error) {
+	if err = store.Sequence.Set(name, value); err == nil {
+		store.resetGlobalVersions(name)
+	}
+	return
+}
+
+// DeleteSequence deletes a sequence of the store, so it starts again at 1.
+// The global version sequence is refused while events are stored, its values would be allocated again.
+// The check and the delete run in one transaction, so no event is saved in between.
+func (store *Store) DeleteSequence(ctx context.Context, name string) (err error) {
+	// the collections are loaded before the transaction
+	var aggregates []*Aggregate
+	if name == GlobalVersionSequence {
+		if aggregates, err = store.aggregates(); err != nil {
+			return
+		}
+	}
+
+	err = store.App().RunInTransaction(func(txApp pbcore.App) (txErr error) {
+		for _, aggregate := range aggregates {
+			var stored bool
+			if stored, txErr = aggregate.hasEventsTx(ctx, txApp); txErr != nil {
+				return
+			}
+			if stored {
+				txErr = fmt.Errorf("%w: %v", ErrSequenceInUse, name)
+				return
+			}
+		}
+		txErr = store.Sequence.DeleteTx(txApp, name)
 		return
+	})
+	if err == nil {
+		store.resetGlobalVersions(name)
 	}
+	return
+}
 
-	//aggregateID := events[0].AggregateID
-	aggType := events[0].AggregateType
+// resetGlobalVersions discards the reserved blocks of the global versions, after the sequence was changed
+func (store *Store) resetGlobalVersions(name string) {
+	if blocks, ok := store.GlobalVersions.(*db.SequenceBlocks); ok && name == GlobalVersionSequence {
+		blocks.Reset()
+	}
+}
 
-	var aggTypeCollection *Aggregate
-	if aggTypeCollection, err = store.GetOrCreateForAggType(aggType); err != nil {
+// aggregates returns the aggregates of all registered aggregate types,
+// the aggregate of all types in the single collection storage
+func (store *Store) aggregates() (ret []*Aggregate, err error) {
+	if store.Storage == StorageSingleCollection {
+		var events *Aggregate
+		if events, err = store.GetOrCreateForAggType(""); err != nil {
+			return
+		}
+		ret = []*Aggregate{events}
 		return
 	}
 
-	err = aggTypeCollection.Save(events)
+	var aggTypes map[string]string
+	if aggTypes, err = store.AggregateTypes.FindAll(); err != nil {
+		return
+	}
+	for aggType := range aggTypes {
+		var aggregate *Aggregate
+		if aggregate, err = store.GetOrCreateForAggType(aggType); err != nil {
+			return
+		}
+		ret = append(ret, aggregate)
+	}
 	return
 }
 
+// GetOrCreateForAggType returns the aggregate type, its collections are created on first use.
+// Concurrent calls for the same aggregate type share one load.
+// In the single collection storage the empty aggregate type returns the aggregate of all types.
 func (store *Store) GetOrCreateForAggType(aggType string) (ret *Aggregate, err error) {
+	if aggType == "" && store.Storage != StorageSingleCollection {
+		err = fmt.Errorf("the aggregate type is required")
+		return
+	}
+
+	store.mu.RLock()
+	ret = store.aggTypeCols[aggType]
+	store.mu.RUnlock()
+	if ret != nil {
+		return
+	}
+
+	var loaded any
+	if loaded, err, _ = store.loads.Do(aggType, func() (any, error) {
+		return store.loadAggregate(aggType)
+	}); err != nil {
+		return
+	}
+	ret = loaded.(*Aggregate)
+	return
+}
+
+func (store *Store) loadAggregate(aggType string) (ret *Aggregate, err error) {
+	store.mu.RLock()
 	ret = store.aggTypeCols[aggType]
-	if ret == nil {
-		ret = NewAggregate(aggType, store.User, store.AuthRoles, store.Sequence, store.Env)
-		store.aggTypeCols[aggType] = ret
+	store.mu.RUnlock()
+	if ret != nil {
+		return
+	}
+
+	ret = store.newAggregate(aggType, store.Env)
+	if err = ret.Load(); err != nil {
+		return
+	}
+	if aggType != "" {
+		if err = store.AggregateTypes.Register(aggType, ret.Name); err != nil {
+			return
+		}
+	}
+
+	store.mu.Lock()
+	store.aggTypeCols[aggType] = ret
+	if !ret.Shared {
+		store.colAggTypes[ret.Name] = aggType
+	}
+	store.mu.Unlock()
+	return
+}
+
+func (store *Store) globalVersions() (ret db.SequenceAllocator) {
+	if ret = store.GlobalVersions; ret == nil {
+		ret = store.Sequence
+	}
+	return
+}
+
+// newAggregate creates the aggregate type in the storage layout of the store
+func (store *Store) newAggregate(aggType string, env db.Env) (ret *Aggregate) {
+	ret = store.newAggregateIn(store.Storage, aggType, env)
+	return
+}
+
+// newAggregateIn creates the aggregate type in the storage layout with the settings of the store
+func (store *Store) newAggregateIn(storage Storage, aggType string, env db.Env) (ret *Aggregate) {
+	if storage == StorageSingleCollection {
+		ret = NewSharedAggregate(aggType, store.User, store.AuthRoles, store.Sequence, env)
+	} else {
+		ret = NewAggregate(aggType, store.User, store.AuthRoles, store.Sequence, env)
 	}
-	err = ret.Load()
+	ret.Outbox = store.Outbox
+	ret.Codec = store.Codec
+	ret.Keys = store.Keys
+	ret.Upcasters = store.Upcasters
+	ret.GlobalVersions = store.GlobalVersions
+	ret.FastPath = store.FastPath
+	ret.saved = &store.saved
 	return
 }
 
+// AggregateTypeOf returns the aggregate type of a collection known to the store.
+// The events collection of the single collection storage has no aggregate type, see AggregateTypeOfRecord.
+func (store *Store) AggregateTypeOf(colName string) (ret string, ok bool) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	ret, ok = store.colAggTypes[colName]
+	return
+}
+
+// AggregateTypeOfRecord returns the aggregate type of an event record of the store
+func (store *Store) AggregateTypeOfRecord(record *pbcore.Record) (ret string, ok bool) {
+	if store.Storage == StorageSingleCollection {
+		if ok = record.Collection().Name == EventsColName; ok {
+			ret = record.GetString(AggTypeFieldAggType)
+		}
+		return
+	}
+	ret, ok = store.AggregateTypeOf(record.Collection().Name)
+	return
+}
+
+// Invalidate removes the aggregate type from the cache, it is loaded again on next use
+func (store *Store) Invalidate(aggType string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if aggregate := store.aggTypeCols[aggType]; aggregate != nil {
+		delete(store.colAggTypes, aggregate.Name)
+		delete(store.aggTypeCols, aggType)
+	}
+}
+
+// bindCollectionHooks invalidates the cached aggregate types, when their collections are changed or deleted
+func (store *Store) bindCollectionHooks() {
+	invalidate := func(e *pbcore.CollectionEvent) error {
+		store.invalidateCollection(e.Collection.Name)
+		return e.Next()
+	}
+	store.App().OnCollectionAfterUpdateSuccess().BindFunc(invalidate)
+	store.App().OnCollectionAfterDeleteSuccess().BindFunc(invalidate)
+}
+
+func (store *Store) invalidateCollection(colName string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for aggType, aggregate := range store.aggTypeCols {
+		if aggregate.Name == colName || aggregate.CollectionAuth.Name == colName {
+			delete(store.colAggTypes, aggregate.Name)
+			delete(store.aggTypeCols, aggType)
+		}
+	}
+}
+
 func buildAggTypeColName(aggType string) (ret string) {
 	return es.ToSnakeCase(aggType)
 }
 
-func NewEvent(record *pbcore.Record, aggType string) (ret *core.Event) {
+// NewEvent creates the event of the record, encoded Data and Metadata are decoded
+func NewEvent(record *pbcore.Record, aggType string) (ret *core.Event, err error) {
 	ret = &core.Event{
 		AggregateID:   record.GetString(AggTypeFieldAggId),
 		Version:       core.Version(record.GetInt(AggTypeFieldVersion)),
@@ -102,13 +383,16 @@ func NewEvent(record *pbcore.Record, aggType string) (ret *core.Event) {
 		AggregateType: aggType,
 		Reason:        record.GetString(AggTypeFieldReason),
 		Timestamp:     record.GetDateTime(AggTypeFieldTimestamp).Time(),
-		Data:          record.Get(AggTypeFieldData).(types.JSONRaw),
-		Metadata:      record.Get(AggTypeFieldMetadata).(types.JSONRaw),
 	}
+	if ret.Data, err = decodePayload(record.Get(AggTypeFieldData).(types.JSONRaw)); err != nil {
+		return
+	}
+	ret.Metadata, err = decodePayload(record.Get(AggTypeFieldMetadata).(types.JSONRaw))
 	return
 }
 
-func NewRecord(event *core.Event, coll *pbcore.Collection) (ret *pbcore.Record) {
+// NewRecord creates the record of the event, Data and Metadata are encoded with the codec, if not nil
+func NewRecord(event *core.Event, coll *pbcore.Collection, codec Codec) (ret *pbcore.Record, err error) {
 	ret = pbcore.NewRecord(coll)
 
 	ret.Set(AggTypeFieldAggId, event.AggregateID)
@@ -116,8 +400,20 @@ func NewRecord(event *core.Event, coll *pbcore.Collection) (ret *pbcore.Record)
 	ret.Set(AggTypeFieldGlobalVersion, uint64(event.GlobalVersion))
 	ret.Set(AggTypeFieldReason, event.Reason)
 	ret.Set(AggTypeFieldTimestamp, event.Timestamp)
-	ret.Set(AggTypeFieldData, event.Data)
-	ret.Set(AggTypeFieldMetadata, event.Metadata)
+	err = setPayload(ret, event, codec)
+	return
+}
+
+func setPayload(record *pbcore.Record, event *core.Event, codec Codec) (err error) {
+	var data, metadata []byte
+	if data, err = encodePayload(codec, event.Data); err != nil {
+		return
+	}
+	if metadata, err = encodePayload(codec, event.Metadata); err != nil {
+		return
+	}
+	record.Set(AggTypeFieldData, data)
+	record.Set(AggTypeFieldMetadata, metadata)
 	return
 }
 
@@ -127,6 +423,19 @@ func NewAggregate(aggType string, user *db.User, authRoles []string, sequence *d
 		Auth:          db.NewAuth(colName, AggTypeFieldAggId, user, authRoles, env),
 		Sequence:      sequence,
 		AggregateType: aggType,
+		PageSize:      DefaultPageSize,
+	}
+}
+
+// NewSharedAggregate creates the aggregate type in the events collection of the single collection storage.
+// The authorizations of all aggregate types share the events_auth collection, keyed by agg_type and agg_id.
+func NewSharedAggregate(aggType string, user *db.User, authRoles []string, sequence *db.Sequence, env db.Env) *Aggregate {
+	return &Aggregate{
+		Auth:          db.NewScopedAuth(EventsColName, AggTypeFieldAggType, AggTypeFieldAggId, user, authRoles, env),
+		Sequence:      sequence,
+		AggregateType: aggType,
+		PageSize:      DefaultPageSize,
+		Shared:        true,
 	}
 }
 
@@ -134,6 +443,19 @@ type Aggregate struct {
 	db.Auth
 	Sequence      *db.Sequence
 	AggregateType string
+	// Shared is true, if the collection stores the events of all aggregate types
+	Shared    bool
+	PageSize  int
+	Outbox    *Outbox
+	Codec     Codec
+	Keys      *Keys
+	Upcasters *Upcasters
+	// GlobalVersions allocates the global versions, see Store.GlobalVersions
+	GlobalVersions db.SequenceAllocator
+	// FastPath bypasses PocketBase records for event rows, see Store.FastPath
+	FastPath bool
+
+	saved *savedHandlers
 }
 
 func (o *Aggregate) Load() (err error) {
@@ -178,13 +500,29 @@ func (o *Aggregate) Load() (err error) {
 				Required: true,
 			},
 			&pbcore.JSONField{
-				Name:     AggTypeFieldMetadata,
-				Required: true,
-				MaxSize:  102400,
+				Name:    AggTypeFieldData,
+				MaxSize: PayloadMaxSize,
+			},
+			&pbcore.JSONField{
+				Name:    AggTypeFieldMetadata,
+				MaxSize: PayloadMaxSize,
+			},
+			&pbcore.TextField{
+				Name: AggTypeFieldEventId,
 			},
 		)
-		indexName := fmt.Sprintf("idx_%v_%v", o.Name, AggTypeFieldAggId)
-		o.Collection.AddIndex(indexName, true, AggTypeFieldAggId, "")
+		// the unique index enforces the optimistic concurrency also between processes sharing the database
+		o.Collection.AddIndex(o.versionIndexName(), true, o.versionIndexColumns(), "")
+		o.Collection.AddIndex(o.eventIdIndexName(), true,
+			AggTypeFieldEventId, fmt.Sprintf("%v != ''", AggTypeFieldEventId))
+		// the reads in global_version order page over the index
+		o.Collection.AddIndex(o.globalVersionIndexName(), false, AggTypeFieldGlobalVersion, "")
+		if o.Shared {
+			o.Collection.Fields.Add(&pbcore.TextField{
+				Name:     AggTypeFieldAggType,
+				Required: true,
+			})
+		}
 
 		if !o.IsAuthDisabled() {
 			o.Collection.ListRule = types.Pointer(o.Auth.AuthBuilder.ListRule())
@@ -197,29 +535,123 @@ func (o *Aggregate) Load() (err error) {
 		}
 
 		err = dao.Save(o.Collection)
+	} else if err == nil {
+		err = o.migrate()
 	}
 	return
 }
 
-func (o *Aggregate) Get(_ context.Context,
-	aggId string, aggType string, afterVersion core.Version) (ret core.Iterator, err error) {
+// migrate upgrades the schema of a collection created by an older version
+func (o *Aggregate) migrate() (err error) {
+	changed := false
 
-	fmt.Printf("aggType: %v, %v: %v", aggType, AggTypeFieldAggId, aggId)
-	var records []*pbcore.Record
-	dao := o.App()
-	if records, err = dao.FindRecordsByFilter(o.Collection.Id,
-		fmt.Sprintf("%v = {:%v} and %v > {:%v}", AggTypeFieldAggId, AggTypeFieldAggId,
-			AggTypeFieldVersion, AggTypeFieldVersion), AggTypeFieldVersion+" asc", 0, 0,
-		dbx.Params{AggTypeFieldAggId: aggId, AggTypeFieldVersion: afterVersion},
-	); err != nil {
-		//TODO maybe we need to ignore );sql.ErrNoRows {
+	if o.Collection.Fields.GetByName(AggTypeFieldData) == nil {
+		o.Collection.Fields.Add(&pbcore.JSONField{Name: AggTypeFieldData, MaxSize: PayloadMaxSize})
+		changed = true
+	}
+	if metadata, ok := o.Collection.Fields.GetByName(AggTypeFieldMetadata).(*pbcore.JSONField); ok && metadata.Required {
+		metadata.Required = false
+		changed = true
+	}
+	if o.Collection.Fields.GetByName(AggTypeFieldEventId) == nil {
+		o.Collection.Fields.Add(&pbcore.TextField{Name: AggTypeFieldEventId})
+		o.Collection.AddIndex(o.eventIdIndexName(), true,
+			AggTypeFieldEventId, fmt.Sprintf("%v != ''", AggTypeFieldEventId))
+		changed = true
+	}
+
+	// the former unique index on agg_id allowed only one event per aggregate
+	if formerIndex := fmt.Sprintf("idx_%v_%v", o.Name, AggTypeFieldAggId); o.Collection.GetIndex(formerIndex) != "" {
+		o.Collection.RemoveIndex(formerIndex)
+		changed = true
+	}
+	if index := o.Collection.GetIndex(o.versionIndexName()); !strings.HasPrefix(strings.ToUpper(index), "CREATE UNIQUE") {
+		o.Collection.AddIndex(o.versionIndexName(), true, o.versionIndexColumns(), "")
+		changed = true
+	}
+	if o.Collection.GetIndex(o.globalVersionIndexName()) == "" {
+		o.Collection.AddIndex(o.globalVersionIndexName(), false, AggTypeFieldGlobalVersion, "")
+		changed = true
+	}
+	// the former rules of the shared collection granted access to the agg_id of any aggregate type
+	if !o.IsAuthDisabled() && !o.Auth.AuthBuilder.HasScopedRules(o.Collection) {
+		o.Collection.ListRule = types.Pointer(o.Auth.AuthBuilder.ListRule())
+		o.Collection.ViewRule = types.Pointer(o.Auth.AuthBuilder.ViewRule())
+		o.Collection.CreateRule = types.Pointer(o.Auth.AuthBuilder.CreateRule())
+		o.Collection.UpdateRule = types.Pointer(o.Auth.AuthBuilder.UpdateRule())
+		o.Collection.DeleteRule = types.Pointer(o.Auth.AuthBuilder.DeleteRule())
+		changed = true
+	}
+
+	if changed {
+		if err = o.App().Save(o.Collection); err != nil {
+			err = fmt.Errorf("migrate the collection %v: %w", o.Name, err)
+		}
+	}
+	return
+}
+
+func (o *Aggregate) versionIndexName() string {
+	return fmt.Sprintf("idx_%v_%v_%v", o.Name, AggTypeFieldAggId, AggTypeFieldVersion)
+}
+
+func (o *Aggregate) versionIndexColumns() string {
+	if o.Shared {
+		return fmt.Sprintf("%v, %v, %v", AggTypeFieldAggType, AggTypeFieldAggId, AggTypeFieldVersion)
+	}
+	return fmt.Sprintf("%v, %v", AggTypeFieldAggId, AggTypeFieldVersion)
+}
+
+// RecordQuery returns a query over the event records of the aggregate type
+func (o *Aggregate) RecordQuery(app pbcore.App) (ret *dbx.SelectQuery) {
+	ret = app.RecordQuery(o.Collection)
+	if o.Shared && o.AggregateType != "" {
+		ret.AndWhere(dbx.HashExp{o.column(AggTypeFieldAggType): o.AggregateType})
+	}
+	return
+}
+
+// column qualifies the field by the collection, the access rules join auth collections with the same fields
+func (o *Aggregate) column(field string) string {
+	return o.Collection.Name + "." + field
+}
+
+// CountEvents returns the number of stored events of the aggregate type
+func (o *Aggregate) CountEvents() (ret int64, err error) {
+	err = o.RecordQuery(o.App()).Select("count(*)").Row(&ret)
+	return
+}
+
+// hasEventsTx returns true, if events of the aggregate type are stored
+func (o *Aggregate) hasEventsTx(ctx context.Context, txApp pbcore.App) (ret bool, err error) {
+	var id string
+	if err = o.RecordQuery(txApp).WithContext(ctx).Select(o.column(pbcore.FieldNameId)).Limit(1).Row(&id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = nil
+		}
 		return
 	}
-	ret = NewIterator(aggType, records)
+	ret = true
 	return
 }
 
-// Save persists events to the collections for aggregate type
+func (o *Aggregate) eventIdIndexName() string {
+	return fmt.Sprintf("idx_%v_%v", o.Name, AggTypeFieldEventId)
+}
+
+func (o *Aggregate) globalVersionIndexName() string {
+	return fmt.Sprintf("idx_%v_%v", o.Name, AggTypeFieldGlobalVersion)
+}
+
+// Get returns an iterator, which reads the events of the aggregate lazily page by page
+func (o *Aggregate) Get(ctx context.Context,
+	aggId string, _ string, afterVersion core.Version) (ret core.Iterator, err error) {
+
+	ret = NewIterator(ctx, o, aggId, afterVersion, o.PageSize)
+	return
+}
+
+// Save persists events of one aggregate to the collection for aggregate type
 func (o *Aggregate) Save(events []core.Event) (err error) {
 	// If no event return no error
 	if len(events) == 0 {
@@ -227,48 +659,250 @@ func (o *Aggregate) Save(events []core.Event) (err error) {
 	}
 
 	err = o.App().RunInTransaction(func(txApp pbcore.App) (txErr error) {
-		aggId := events[0].AggregateID
-		aggType := events[0].AggregateType
-		fmt.Printf("aggType: %v, %v: %v", aggType, AggTypeFieldAggId, aggId)
+		var stream *streamEvents
+		if stream, txErr = o.prepareTx(txApp, events); txErr != nil || stream.replayed {
+			return
+		}
 
-		var record *pbcore.Record
-		if record, txErr = txApp.FindFirstRecordByFilter(o.Collection.Id,
-			fmt.Sprintf("%v = {:%v}", AggTypeFieldAggId, AggTypeFieldAggId),
-			dbx.Params{AggTypeFieldAggId: aggId},
-		); txErr != nil && !errors.Is(txErr, sql.ErrNoRows) {
+		var globalVersions []int
+		if globalVersions, txErr = o.globalVersions().GetNextMultipleTx(txApp, GlobalVersionSequence, len(events)); txErr != nil {
 			return
 		}
 
-		var currentVersion core.Version
-		if record != nil {
-			currentVersion = core.Version(record.GetInt(AggTypeFieldVersion))
-		} else {
-			currentVersion = core.Version(0)
+		for i := range events {
+			events[i].GlobalVersion = core.Version(globalVersions[i])
 		}
+		txErr = o.insertTx(txApp, stream)
+		return
+	})
+	return
+}
 
-		// Make sure no other has saved event to the same aggregate concurrently
-		firstEventVersion := events[0].Version
-		if currentVersion+1 != firstEventVersion {
-			txErr = core.ErrConcurrency
+// streamEvents are the events of one aggregate checked for saving
+type streamEvents struct {
+	events   []*core.Event
+	eventIds []string
+	replayed bool
+}
+
+// prepareTx checks, if the events of one aggregate can be appended.
+// A replay of an already stored batch is marked as replayed and gets the stored versions.
+func (o *Aggregate) prepareTx(txApp pbcore.App, events []core.Event) (ret *streamEvents, err error) {
+	ret = &streamEvents{
+		events:   make([]*core.Event, len(events)),
+		eventIds: make([]string, len(events)),
+	}
+	for i := range events {
+		ret.events[i] = &events[i]
+	}
+	err = o.prepareStreamTx(txApp, ret)
+	return
+}
+
+func (o *Aggregate) prepareStreamTx(txApp pbcore.App, stream *streamEvents) (err error) {
+	aggId := stream.events[0].AggregateID
+
+	for i, event := range stream.events {
+		if stream.eventIds[i], err = EventIdOf(event); err != nil {
 			return
 		}
+	}
+
+	var stored []*pbcore.Record
+	if stored, err = o.findByEventIds(txApp, stream.eventIds); err != nil {
+		return
+	}
+	if len(stored) > 0 {
+		if err = replayed(stream.events, stream.eventIds, stored); err == nil {
+			stream.replayed = true
+		}
+		return
+	}
 
-		var globalVersions []int
-		if globalVersions, txErr = o.Sequence.GetNextMultipleTx(txApp, aggregates_golabl_version, len(events)); err != nil {
-			return
+	var currentVersion core.Version
+	if currentVersion, err = o.latestVersionTx(txApp, aggId); err != nil {
+		return
+	}
+
+	// Make sure no other has saved event to the same aggregate concurrently,
+	// a concurrent append of another process is rejected by the unique index on insert
+	firstEventVersion := stream.events[0].Version
+	if currentVersion+1 != firstEventVersion {
+		err = core.ErrConcurrency
+	}
+	return
+}
+
+// latestVersionTx returns the latest stored version of the aggregate, 0 if it has no events
+func (o *Aggregate) latestVersionTx(txApp pbcore.App, aggId string) (ret core.Version, err error) {
+	var record pbcore.Record
+	if err = o.RecordQuery(txApp).
+		AndWhere(dbx.HashExp{AggTypeFieldAggId: aggId}).
+		OrderBy(AggTypeFieldVersion + " DESC").
+		Limit(1).
+		One(&record); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = nil
+		}
+		return
+	}
+	ret = core.Version(record.GetInt(AggTypeFieldVersion))
+	return
+}
+
+// isUniqueViolation returns true, if the error is caused by a unique index,
+// either checked by the validation of PocketBase or reported by the database
+func isUniqueViolation(err error) bool {
+	var validationErrs validation.Errors
+	if errors.As(err, &validationErrs) {
+		for _, fieldErr := range validationErrs {
+			var codeErr validation.Error
+			if errors.As(fieldErr, &codeErr) && codeErr.Code() == "validation_not_unique" {
+				return true
+			}
 		}
+	}
+	return strings.Contains(strings.ToLower(err.Error()), "unique constraint failed")
+}
 
-		for i, event := range events {
+func (o *Aggregate) globalVersions() (ret db.SequenceAllocator) {
+	if ret = o.GlobalVersions; ret == nil {
+		ret = o.Sequence
+	}
+	return
+}
 
-			event.GlobalVersion = core.Version(globalVersions[i])
+// insertTx writes the prepared events, their global versions must be set already
+func (o *Aggregate) insertTx(txApp pbcore.App, stream *streamEvents) (err error) {
+	if o.Upcasters != nil {
+		for _, event := range stream.events {
+			if err = o.Upcasters.stamp(event); err != nil {
+				return
+			}
+		}
+	}
 
-			record = NewRecord(&event, o.Collection)
+	if o.FastPath {
+		err = o.insertRowsTx(txApp, stream)
+	} else {
+		err = o.insertRecordsTx(txApp, stream)
+	}
+	if err != nil {
+		if isUniqueViolation(err) {
+			err = fmt.Errorf("%w: %v", core.ErrConcurrency, err)
+		}
+		return
+	}
 
-			if txErr = txApp.Save(record); txErr != nil {
+	if o.Outbox != nil {
+		for _, event := range stream.events {
+			if err = o.Outbox.AddTx(txApp, event); err != nil {
 				return
 			}
 		}
+	}
+
+	o.saved.notifyTx(txApp, stream.events)
+	return
+}
+
+func (o *Aggregate) insertRecordsTx(txApp pbcore.App, stream *streamEvents) (err error) {
+	for i, event := range stream.events {
+		var record *pbcore.Record
+		if record, err = o.newRecordTx(txApp, event, stream.eventIds[i]); err != nil {
+			return
+		}
+		if err = txApp.Save(record); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// newRecordTx creates the record of the event with the codec and the encryption of the aggregate type
+func (o *Aggregate) newRecordTx(txApp pbcore.App, event *core.Event, eventId string) (ret *pbcore.Record, err error) {
+	if ret, err = NewRecord(event, o.Collection, o.Codec); err != nil {
 		return
-	})
+	}
+	if o.Keys != nil {
+		if err = o.Keys.encryptRecordTx(txApp, ret, event); err != nil {
+			return
+		}
+	}
+	ret.Set(AggTypeFieldEventId, eventId)
+	if o.Shared {
+		ret.Set(AggTypeFieldAggType, event.AggregateType)
+	}
+	return
+}
+
+// newEvent creates the event of the record with decrypted and upcasted Data
+func (o *Aggregate) newEvent(record *pbcore.Record) (ret *core.Event, err error) {
+	aggType := o.AggregateType
+	if o.Shared {
+		aggType = record.GetString(AggTypeFieldAggType)
+	}
+	if ret, err = NewEvent(record, aggType); err != nil {
+		return
+	}
+	err = openEvent(ret, o.Keys, o.Upcasters)
+	return
+}
+
+// openEvent decrypts and upcasts the Data of a stored event, keys and upcasters are optional
+func openEvent(event *core.Event, keys *Keys, upcasters *Upcasters) (err error) {
+	if keys != nil {
+		if err = keys.decryptEvent(event); err != nil {
+			return
+		}
+	}
+	if upcasters != nil && !IsRedacted(event) {
+		err = upcasters.Upcast(event)
+	}
 	return
 }
+
+// replayed takes over the stored versions, if all events of the batch are stored already.
+// A retry may recompute the versions, but the stored events must be of the same aggregate,
+// reasons and order, otherwise the event ids are reused for other events and not replayed.
+func replayed(events []*core.Event, eventIds []string, stored []*pbcore.Record) (err error) {
+	storedById := make(map[string]*pbcore.Record, len(stored))
+	for _, record := range stored {
+		storedById[record.GetString(AggTypeFieldEventId)] = record
+	}
+
+	if len(storedById) != len(events) {
+		err = fmt.Errorf("%w: %v of %v events already stored", core.ErrConcurrency, len(storedById), len(events))
+		return
+	}
+
+	// the offset of recomputed versions, it is the same for all events of a replay
+	var offset core.Version
+	if record := storedById[eventIds[0]]; record != nil {
+		offset = core.Version(record.GetInt(AggTypeFieldVersion)) - events[0].Version
+	}
+	for i, eventId := range eventIds {
+		record := storedById[eventId]
+		if record == nil {
+			err = fmt.Errorf("%w: event %v not stored", core.ErrConcurrency, eventId)
+			return
+		}
+		storedVersion := core.Version(record.GetInt(AggTypeFieldVersion))
+		if !isStoredEvent(record, events[i]) || storedVersion-events[i].Version != offset {
+			err = fmt.Errorf("%w: event id %v is stored for another event", core.ErrConcurrency, eventId)
+			return
+		}
+		events[i].Version = storedVersion
+		events[i].GlobalVersion = core.Version(record.GetInt(AggTypeFieldGlobalVersion))
+	}
+	return
+}
+
+// isStoredEvent returns true, if the record stores an event of the aggregate with the reason.
+// The agg_type is stored in the single collection storage only.
+func isStoredEvent(record *pbcore.Record, event *core.Event) bool {
+	if aggType := record.GetString(AggTypeFieldAggType); aggType != "" && aggType != event.AggregateType {
+		return false
+	}
+	return record.GetString(AggTypeFieldAggId) == event.AggregateID && record.GetString(AggTypeFieldReason) == event.Reason
+}
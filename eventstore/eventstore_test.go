@@ -1,41 +1,45 @@
 package eventstore
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"github.com/go-ee/eventsoutcing_pocketbase/db"
-	"github.com/pocketbase/pocketbase"
+	"github.com/go-ee/eventsoutcing_pocketbase/internal/testapp"
 	pbcore "github.com/pocketbase/pocketbase/core"
-	"log"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/hallgren/eventsourcing/core"
 	"github.com/hallgren/eventsourcing/core/testsuite"
 )
 
 func TestSuite(t *testing.T) {
-	var wg sync.WaitGroup
-	wg.Add(1)
-
-	appInst := &app{
-		PocketBase: pocketbase.New(),
-	}
+	appInst, user := testapp.New(t)
 
-	err := appInst.Bootstrap()
+	f := func() (store core.EventStore, closeFunc func(), err error) {
+		storeCol := New(user, testapp.AuthRoles, appInst)
+		if err = storeCol.Load(); err != nil {
+			return
+		}
+		store = storeCol
 
-	if err != nil {
-		t.Fatalf("Failed to bootstrap PocketBase app: %v", err)
+		closeFunc = func() {
+		}
+		return
 	}
+	testsuite.Test(t, f)
+}
 
-	log.Printf("Pocketbase data dir: %v\n", appInst.DataDir())
-
-	user := db.NewUser(appInst)
-	err = user.Load()
-	if err != nil {
-		t.Fatalf("Failed to load user: %v", err)
-	}
+func TestSuiteSingleCollection(t *testing.T) {
+	appInst, user := testapp.New(t)
 
 	f := func() (store core.EventStore, closeFunc func(), err error) {
-		storeCol := New(user, []string{"admin", "maintainer", "user"}, appInst)
+		storeCol := New(user, testapp.AuthRoles, appInst)
+		storeCol.Storage = StorageSingleCollection
 		if err = storeCol.Load(); err != nil {
 			return
 		}
@@ -48,26 +52,1240 @@ func TestSuite(t *testing.T) {
 	testsuite.Test(t, f)
 }
 
-type app struct {
-	*pocketbase.PocketBase
+func TestSuiteFastPath(t *testing.T) {
+	for _, storage := range []Storage{StorageCollectionPerType, StorageSingleCollection} {
+		t.Run(storage.String(), func(t *testing.T) {
+			appInst, user := testapp.New(t)
+
+			f := func() (store core.EventStore, closeFunc func(), err error) {
+				storeCol := New(user, testapp.AuthRoles, appInst)
+				storeCol.Storage = storage
+				storeCol.FastPath = true
+				if err = storeCol.Load(); err != nil {
+					return
+				}
+				store = storeCol
+
+				closeFunc = func() {
+				}
+				return
+			}
+			testsuite.Test(t, f)
+		})
+	}
+}
+
+func TestFastPathReadsRecords(t *testing.T) {
+	appInst, user := testapp.New(t)
+	store := New(user, testapp.AuthRoles, appInst)
+	store.Codec = &GzipCodec{}
+	if err := store.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	large := testEvent("Person", "p1", 1)
+	large.Data = []byte(`{"name":"` + strings.Repeat("a", 1024) + `"}`)
+	if err := store.Save([]core.Event{large}); err != nil {
+		t.Fatal(err)
+	}
+
+	// rows written by the fast path are readable as records and the other way around
+	store.FastPath = true
+	store.Invalidate("Person")
+	saveTestEvent(t, store, "Person", "p1", 2)
+
+	for _, fastPath := range []bool{true, false} {
+		store.FastPath = fastPath
+		store.Invalidate("Person")
+
+		events := fetchAll(t, store.All(context.Background(), 0, 0))
+		if len(events) != 2 || !bytes.Equal(events[0].Data, large.Data) || events[1].Version != 2 ||
+			events[1].AggregateType != "Person" || string(events[1].Metadata) != `{"test":"hello"}` {
+			t.Fatalf("fast path %v: unexpected events %+v", fastPath, events)
+		}
+	}
+}
+
+func TestFastPathBatches(t *testing.T) {
+	appInst, user := testapp.New(t)
+	store := New(user, testapp.AuthRoles, appInst)
+	store.FastPath = true
+	if err := store.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	// two full batches share the prepared INSERT, the rest gets its own
+	events := make([]core.Event, 2*fastPathInsertRows+1)
+	for i := range events {
+		events[i] = testEvent("Person", "p1", core.Version(i+1))
+	}
+	if err := store.Save(events); err != nil {
+		t.Fatal(err)
+	}
+
+	stored := fetchAll(t, store.All(context.Background(), 0, 0))
+	if len(stored) != len(events) || stored[len(stored)-1].Version != core.Version(len(events)) {
+		t.Fatalf("expected %d events, got %d", len(events), len(stored))
+	}
+}
+
+func TestAll(t *testing.T) {
+	appInst, user := testapp.New(t)
+
+	store := New(user, testapp.AuthRoles, appInst)
+	if err := store.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	saveTestEvent(t, store, "Person", "p1", 1)
+	saveTestEvent(t, store, "Order", "o1", 1)
+	saveTestEvent(t, store, "Person", "p2", 1)
+
+	fetch := store.All(context.Background(), 0, 2)
+
+	events := fetchAll(t, fetch)
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events in first batch, got %d", len(events))
+	}
+	if events[0].AggregateType != "Person" || events[1].AggregateType != "Order" {
+		t.Fatalf("wrong global order: %v, %v", events[0].AggregateType, events[1].AggregateType)
+	}
+	if events[0].GlobalVersion >= events[1].GlobalVersion {
+		t.Fatalf("expected ascending global versions, got %d, %d", events[0].GlobalVersion, events[1].GlobalVersion)
+	}
+
+	events = fetchAll(t, fetch)
+	if len(events) != 1 || events[0].AggregateID != "p2" {
+		t.Fatalf("expected p2 in second batch, got %v", events)
+	}
+
+	if events = fetchAll(t, fetch); len(events) != 0 {
+		t.Fatalf("expected no more events, got %d", len(events))
+	}
+}
+
+func TestIteratorPaging(t *testing.T) {
+	appInst, user := testapp.New(t)
+
+	store := New(user, testapp.AuthRoles, appInst)
+	if err := store.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	var events []core.Event
+	for version := core.Version(1); version <= 5; version++ {
+		events = append(events, testEvent("Person", "p1", version))
+	}
+	if err := store.Save(events); err != nil {
+		t.Fatal(err)
+	}
+
+	aggregate, err := store.GetOrCreateForAggType("Person")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	iterator := NewIterator(context.Background(), aggregate, "p1", 1, 2)
+	var versions []core.Version
+	for iterator.Next() {
+		event, err := iterator.Value()
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, event.Version)
+	}
+	iterator.Close()
+
+	if len(versions) != 4 || versions[0] != 2 || versions[3] != 5 {
+		t.Fatalf("expected versions 2..5, got %v", versions)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	iterator = NewIterator(ctx, aggregate, "p1", 0, 2)
+	if !iterator.Next() {
+		t.Fatal("expected Next to report the pending error")
+	}
+	if _, err = iterator.Value(); err == nil {
+		t.Fatal("expected context error from Value")
+	}
+	if iterator.Next() {
+		t.Fatal("expected iterator to stop after error")
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	appInst, user := testapp.New(t)
+
+	store := New(user, testapp.AuthRoles, appInst)
+	if err := store.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := store.Subscribe(ctx, SubscriptionFilter{AggregateTypes: []string{"Person"}, AggregateIDs: []string{"p1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a rolled back transaction must not be delivered
+	invalid := testEvent("Person", "p1", 2)
+	invalid.Reason = ""
+	if err = store.Save([]core.Event{testEvent("Person", "p1", 1), invalid}); err == nil {
+		t.Fatal("expected validation error")
+	}
+
+	saveTestEvent(t, store, "Person", "p2", 1)
+	saveTestEvent(t, store, "Order", "p1", 1)
+	saveTestEvent(t, store, "Person", "p1", 1)
+
+	select {
+	case event := <-events:
+		if event.AggregateType != "Person" || event.AggregateID != "p1" || event.GlobalVersion == 0 {
+			t.Fatalf("unexpected event %v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event was not delivered")
+	}
+
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected second event %v", event)
+	default:
+	}
+
+	cancel()
+	for range events {
+	}
+}
+
+func TestSubscribeFastPath(t *testing.T) {
+	appInst, user := testapp.New(t)
+
+	store := New(user, testapp.AuthRoles, appInst)
+	store.FastPath = true
+	if err := store.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := store.Subscribe(ctx, SubscriptionFilter{AggregateTypes: []string{"Person"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saveTestEvent(t, store, "Person", "p1", 1)
+
+	select {
+	case event := <-events:
+		if event.AggregateID != "p1" || event.GlobalVersion == 0 || string(event.Data) != `{"name":"test"}` {
+			t.Fatalf("unexpected event %v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event of the fast path was not delivered")
+	}
+}
+
+func TestSubscribeSlowConsumer(t *testing.T) {
+	appInst, user := testapp.New(t)
+
+	store := New(user, testapp.AuthRoles, appInst)
+	if err := store.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the handler blocks, until the saves are done
+	release := make(chan struct{})
+	handled := make(chan core.Event, 2)
+	unsubscribe, err := store.SubscribeFunc(SubscriptionFilter{}, func(event core.Event) {
+		<-release
+		handled <- event
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unsubscribe()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := store.Subscribe(ctx, SubscriptionFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := make(chan error)
+	go func() {
+		batch := make([]core.Event, DefaultSubscriptionBufferSize+1)
+		for i := range batch {
+			batch[i] = testEvent("Person", "p1", core.Version(i+1))
+		}
+		saved <- store.Save(batch)
+	}()
+	select {
+	case err = <-saved:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the save is blocked by the subscribers")
+	}
+
+	close(release)
+	select {
+	case event := <-handled:
+		if event.Version != 1 {
+			t.Fatalf("expected the first event, got %v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event was not handled")
+	}
+
+	// the channel consumer fell behind, it is disconnected after the buffered events
+	received := 0
+	for range events {
+		received++
+	}
+	if received != DefaultSubscriptionBufferSize {
+		t.Fatalf("expected %d buffered events, got %d", DefaultSubscriptionBufferSize, received)
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	appInst, user := testapp.New(t)
+
+	store := New(user, testapp.AuthRoles, appInst)
+	store.Outbox = NewOutbox(appInst)
+	if err := store.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	saveTestEvent(t, store, "Person", "p1", 1)
+	saveTestEvent(t, store, "Order", "o1", 1)
+	if err := store.Save([]core.Event{testEvent("Order", "o1", 1)}); err == nil {
+		t.Fatal("expected concurrency error")
+	}
+
+	var published []core.Event
+	failures := 1
+	dispatcher := NewDispatcher(store.Outbox, PublisherFunc(func(_ context.Context, event core.Event) error {
+		if event.AggregateID == "p1" && failures > 0 {
+			failures--
+			return errors.New("broker not available")
+		}
+		published = append(published, event)
+		return nil
+	}))
+	dispatcher.MinBackoff = 0
+
+	delivered, err := dispatcher.DispatchOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delivered != 1 || published[0].AggregateID != "o1" {
+		t.Fatalf("expected o1 delivered, got %d: %v", delivered, published)
+	}
+
+	if delivered, err = dispatcher.DispatchOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if delivered != 1 || published[1].AggregateID != "p1" || published[1].AggregateType != "Person" {
+		t.Fatalf("expected p1 delivered on retry, got %d: %v", delivered, published)
+	}
 
-	Recreate     bool
-	RecreateAuth bool
-	AuthDisabled bool
+	if delivered, err = dispatcher.DispatchOnce(context.Background()); err != nil || delivered != 0 {
+		t.Fatalf("expected empty outbox, got %d, %v", delivered, err)
+	}
 }
 
-func (db *app) App() pbcore.App {
-	return db.PocketBase
+func TestOutboxBlockedStreams(t *testing.T) {
+	appInst, user := testapp.New(t)
+
+	store := New(user, testapp.AuthRoles, appInst)
+	store.Outbox = NewOutbox(appInst)
+	if err := store.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	for version := core.Version(1); version <= 3; version++ {
+		saveTestEvent(t, store, "Person", "p1", version)
+	}
+	saveTestEvent(t, store, "Person", "p2", 1)
+	saveTestEvent(t, store, "Order", "o1", 1)
+
+	// the entry of p2 can not be decoded
+	record, err := appInst.FindFirstRecordByFilter(store.Outbox.Collection, "agg_id = 'p2'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	record.Set(AggTypeFieldData, `{"$codec":"unknown","data":""}`)
+	if err = appInst.Save(record); err != nil {
+		t.Fatal(err)
+	}
+
+	var published []string
+	dispatcher := NewDispatcher(store.Outbox, PublisherFunc(func(_ context.Context, event core.Event) error {
+		if event.AggregateID == "p1" {
+			return errors.New("broker not available")
+		}
+		published = append(published, event.AggregateID)
+		return nil
+	}))
+	dispatcher.BatchSize = 2
+	dispatcher.MinBackoff = time.Hour
+
+	// the failed p1 is in backoff, its later entries wait and the other streams are published
+	for range 3 {
+		if _, err = dispatcher.DispatchOnce(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(published) != 1 || published[0] != "o1" {
+		t.Fatalf("expected o1 published past the blocked streams, got %v", published)
+	}
+
+	failed, err := appInst.FindFirstRecordByFilter(store.Outbox.Collection, "agg_id = 'p2'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed.GetInt(OutboxFieldAttempts) != 1 || failed.GetString(OutboxFieldLastError) == "" {
+		t.Fatalf("expected the undecodable entry marked failed, got %v", failed)
+	}
 }
 
-func (db *app) IsRecreateDb() bool {
-	return db.Recreate
+func TestIdempotentSave(t *testing.T) {
+	appInst, user := testapp.New(t)
+
+	store := New(user, testapp.AuthRoles, appInst)
+	if err := store.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	withId := func(event core.Event, eventId string) core.Event {
+		event.Metadata = []byte(`{"event_id":"` + eventId + `"}`)
+		return event
+	}
+
+	events := []core.Event{withId(testEvent("Person", "p1", 1), "e1"), withId(testEvent("Person", "p1", 2), "e2")}
+	if err := store.Save(events); err != nil {
+		t.Fatal(err)
+	}
+
+	// retry with recomputed versions
+	replay := []core.Event{withId(testEvent("Person", "p1", 3), "e1"), withId(testEvent("Person", "p1", 4), "e2")}
+	if err := store.Save(replay); err != nil {
+		t.Fatalf("expected replay to succeed, got %v", err)
+	}
+	if replay[0].Version != 1 || replay[1].GlobalVersion != events[1].GlobalVersion {
+		t.Fatalf("expected stored versions on replay, got %v", replay)
+	}
+
+	partial := []core.Event{withId(testEvent("Person", "p1", 3), "e2"), withId(testEvent("Person", "p1", 4), "e3")}
+	if err := store.Save(partial); !errors.Is(err, core.ErrConcurrency) {
+		t.Fatalf("expected concurrency error for partial replay, got %v", err)
+	}
+
+	// a reused event id of another aggregate, reason or order is no replay
+	otherAggregate := []core.Event{withId(testEvent("Person", "p2", 1), "e1")}
+	otherReason := withId(testEvent("Person", "p1", 2), "e2")
+	otherReason.Reason = "Renamed"
+	otherOrder := []core.Event{withId(testEvent("Person", "p1", 3), "e2"), withId(testEvent("Person", "p1", 4), "e1")}
+	for _, reused := range [][]core.Event{otherAggregate, {otherReason}, otherOrder} {
+		if err := store.Save(reused); !errors.Is(err, core.ErrConcurrency) {
+			t.Fatalf("expected concurrency error for a reused event id, got %v", err)
+		}
+	}
+
+	iterator, err := store.Get(context.Background(), "p1", "Person", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iterator.Close()
+	var count int
+	for iterator.Next() {
+		count++
+	}
+	if count != 2 {
+		t.Fatalf("expected 2 stored events, got %d", count)
+	}
 }
 
-func (db *app) IsRecreateDbAuth() bool {
-	return db.RecreateAuth
+func TestSaveMulti(t *testing.T) {
+	appInst, user := testapp.New(t)
+
+	store := New(user, testapp.AuthRoles, appInst)
+	if err := store.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	uow := store.NewUnitOfWork().Add(
+		testEvent("Person", "p1", 1),
+		testEvent("Order", "o1", 1),
+		testEvent("Person", "p1", 2),
+	)
+	if err := uow.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	events := uow.Events()
+	for i := 1; i < len(events); i++ {
+		if events[i].GlobalVersion != events[i-1].GlobalVersion+1 {
+			t.Fatalf("expected consecutive global versions in batch order, got %v", events)
+		}
+	}
+
+	conflicting := []core.Event{testEvent("Person", "p2", 1), testEvent("Order", "o1", 1)}
+	if err := store.SaveMulti(conflicting); !errors.Is(err, core.ErrConcurrency) {
+		t.Fatalf("expected concurrency error, got %v", err)
+	}
+
+	iterator, err := store.Get(context.Background(), "p2", "Person", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iterator.Close()
+	if iterator.Next() {
+		t.Fatal("expected no events of p2 after rollback")
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	sourceApp, sourceUser := testapp.New(t)
+	source := New(sourceUser, testapp.AuthRoles, sourceApp)
+	if err := source.Load(); err != nil {
+		t.Fatal(err)
+	}
+	saveTestEvent(t, source, "Person", "p1", 1)
+	saveTestEvent(t, source, "Order", "o1", 1)
+	saveTestEvent(t, source, "Person", "p1", 2)
+
+	var perAggregate bytes.Buffer
+	if count, err := source.Export(context.Background(), &perAggregate,
+		ExportSelection{AggregateType: "Person", AggregateID: "p1", AfterGlobalVersion: 1}); err != nil || count != 1 {
+		t.Fatalf("expected 1 exported event of p1, got %d, %v", count, err)
+	}
+
+	var upTo bytes.Buffer
+	if count, err := source.Export(context.Background(), &upTo, ExportSelection{ToGlobalVersion: 2}); err != nil ||
+		count != 2 || bytes.Count(upTo.Bytes(), []byte("\n")) != 2 {
+		t.Fatalf("expected 2 exported events up to global version 2, got %d, %v", count, err)
+	}
+
+	var exported bytes.Buffer
+	if count, err := source.Export(context.Background(), &exported, ExportSelection{}); err != nil || count != 3 {
+		t.Fatalf("expected 3 exported events, got %d, %v", count, err)
+	}
+
+	targetApp, targetUser := testapp.New(t)
+	target := New(targetUser, testapp.AuthRoles, targetApp)
+	if err := target.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := target.Import(context.Background(), bytes.NewReader(exported.Bytes()), ImportOptions{DryRun: true})
+	if err != nil || result.Count != 3 {
+		t.Fatalf("expected 3 verified events, got %v, %v", result, err)
+	}
+	if exists, _ := target.AggregateTypes.Exists("Person"); exists {
+		t.Fatal("expected no aggregate types after a dry-run")
+	}
+
+	if result, err = target.Import(context.Background(), bytes.NewReader(exported.Bytes()), ImportOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if result.LastGlobalVersion != 3 || result.AggregateTypes["Person"] != 2 {
+		t.Fatalf("unexpected import result %v", result)
+	}
+
+	events := fetchAll(t, target.All(context.Background(), 0, 0))
+	if len(events) != 3 || events[2].AggregateID != "p1" || events[2].Version != 2 || events[2].GlobalVersion != 3 {
+		t.Fatalf("expected the exported versions, got %v", events)
+	}
+
+	// the sequence continues after the imported global versions
+	saveTestEvent(t, target, "Order", "o1", 2)
+	if current, _ := target.Sequence.Current(GlobalVersionSequence); current != 4 {
+		t.Fatalf("expected global version 4 after import, got %d", current)
+	}
+
+	// a second import collides with the stored global versions
+	if _, err = target.Import(context.Background(), bytes.NewReader(exported.Bytes()), ImportOptions{}); !errors.Is(err, core.ErrConcurrency) {
+		t.Fatalf("expected concurrency error, got %v", err)
+	}
 }
 
-func (db *app) IsAuthDisabled() bool {
-	return db.AuthDisabled
+func TestCodec(t *testing.T) {
+	appInst, user := testapp.New(t)
+
+	store := New(user, testapp.AuthRoles, appInst)
+	if err := store.Load(); err != nil {
+		t.Fatal(err)
+	}
+	saveTestEvent(t, store, "Person", "p1", 1)
+
+	// enable the codec for an existing store, the uncompressed event stays readable
+	store = New(user, testapp.AuthRoles, appInst)
+	store.Codec = &GzipCodec{}
+	if err := store.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	large := testEvent("Person", "p1", 2)
+	large.Data = []byte(`{"text":"` + strings.Repeat("verbose ", 2*PayloadMaxSize/8) + `"}`)
+	if err := store.Save([]core.Event{large}); err != nil {
+		t.Fatal(err)
+	}
+
+	aggregate, err := store.GetOrCreateForAggType("Person")
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := appInst.FindFirstRecordByFilter(aggregate.Collection, "version = 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored := record.GetString(AggTypeFieldData); !strings.HasPrefix(stored, string(codecHeader)) {
+		t.Fatalf("expected encoded data, got %.40v", stored)
+	}
+
+	events := fetchAll(t, store.All(context.Background(), 0, 0))
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(events))
+	}
+	if string(events[0].Data) != `{"name":"test"}` || !bytes.Equal(events[1].Data, large.Data) {
+		t.Fatal("expected the original data of both events")
+	}
+	if string(events[1].Metadata) != string(large.Metadata) {
+		t.Fatalf("expected the original metadata, got %s", events[1].Metadata)
+	}
+
+	// the export writes the decoded data, its lines exceed the encoded payload size
+	huge := testEvent("Person", "p1", 3)
+	huge.Data = []byte(`{"text":"` + strings.Repeat("verbose ", 2*1024*1024/8) + `"}`)
+	if err = store.Save([]core.Event{huge}); err != nil {
+		t.Fatal(err)
+	}
+	var exported bytes.Buffer
+	if _, err = store.Export(context.Background(), &exported, ExportSelection{}); err != nil {
+		t.Fatal(err)
+	}
+
+	targetApp, targetUser := testapp.New(t)
+	target := New(targetUser, testapp.AuthRoles, targetApp)
+	target.Codec = &GzipCodec{}
+	if err = target.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if result, err := target.Import(context.Background(), &exported, ImportOptions{}); err != nil || result.Count != 3 {
+		t.Fatalf("expected 3 imported events, got %v, %v", result, err)
+	}
+	if events = fetchAll(t, target.All(context.Background(), 2, 0)); len(events) != 1 || !bytes.Equal(events[0].Data, huge.Data) {
+		t.Fatal("expected the original data of the imported event")
+	}
+}
+
+func TestDeflateCodec(t *testing.T) {
+	data := []byte(`{"text":"` + strings.Repeat("verbose ", 100) + `"}`)
+	deflated, err := encodePayload(&DeflateCodec{}, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gzipped, err := encodePayload(&GzipCodec{}, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(deflated, codecHeader) || len(deflated) >= len(gzipped) {
+		t.Fatalf("expected the deflate envelope smaller than gzip, got %d and %d bytes", len(deflated), len(gzipped))
+	}
+
+	decoded, err := decodePayload(deflated)
+	if err != nil || !bytes.Equal(decoded, data) {
+		t.Fatalf("expected the original data, got %s, %v", decoded, err)
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	appInst, user := testapp.New(t)
+	env := appInst.WithMasterKey(bytes.Repeat([]byte{7}, 32))
+
+	store := New(user, testapp.AuthRoles, env)
+	store.Keys = NewKeys(env)
+	if err := store.Load(); err != nil {
+		t.Fatal(err)
+	}
+	saveTestEvent(t, store, "Person", "p1", 1)
+	saveTestEvent(t, store, "Person", "p2", 1)
+
+	aggregate, err := store.GetOrCreateForAggType("Person")
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := appInst.FindFirstRecordByFilter(aggregate.Collection, "agg_id = 'p1'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored := record.GetString(AggTypeFieldData); !strings.HasPrefix(stored, string(encryptionHeader)) {
+		t.Fatalf("expected encrypted data, got %v", stored)
+	}
+
+	events := fetchAll(t, store.All(context.Background(), 0, 0))
+	if len(events) != 2 || string(events[0].Data) != `{"name":"test"}` {
+		t.Fatalf("expected the decrypted data, got %v", events)
+	}
+
+	// the key of p2 is unwrapped once and read from the cache afterwards
+	keyRecord, err := appInst.FindFirstRecordByFilter(store.Keys.Collection, "agg_id = 'p2'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyRecord.Set(KeysFieldKey, "")
+	if err = appInst.Save(keyRecord); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = store.Keys.Destroy("Person", "p1"); err != nil {
+		t.Fatal(err)
+	}
+
+	events = fetchAll(t, store.All(context.Background(), 0, 0))
+	if !IsRedacted(&events[0]) || string(events[1].Data) != `{"name":"test"}` {
+		t.Fatalf("expected only p1 redacted, got %v", events)
+	}
+
+	if err = store.Save([]core.Event{testEvent("Person", "p1", 2)}); !errors.Is(err, ErrKeyDestroyed) {
+		t.Fatalf("expected key destroyed error, got %v", err)
+	}
+}
+
+func TestKeyDestroyedByOtherProcess(t *testing.T) {
+	appInst, user := testapp.New(t)
+	env := appInst.WithMasterKey(bytes.Repeat([]byte{7}, 32))
+
+	store := New(user, testapp.AuthRoles, env)
+	store.Keys = NewKeys(env)
+	store.Keys.CacheTTL = 50 * time.Millisecond
+	if err := store.Load(); err != nil {
+		t.Fatal(err)
+	}
+	saveTestEvent(t, store, "Person", "p1", 1)
+
+	events := fetchAll(t, store.All(context.Background(), 0, 0))
+	if len(events) != 1 || IsRedacted(&events[0]) {
+		t.Fatalf("expected the decrypted data, got %v", events)
+	}
+
+	// the other process shares the db, but not the key cache
+	other := NewKeys(env)
+	if err := other.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Destroy("Person", "p1"); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(2 * store.Keys.CacheTTL)
+	events = fetchAll(t, store.All(context.Background(), 0, 0))
+	if len(events) != 1 || !IsRedacted(&events[0]) {
+		t.Fatalf("expected p1 redacted after the cache expired, got %v", events)
+	}
+}
+
+func TestUpcasters(t *testing.T) {
+	appInst, user := testapp.New(t)
+
+	store := New(user, testapp.AuthRoles, appInst)
+	if err := store.Load(); err != nil {
+		t.Fatal(err)
+	}
+	saveTestEvent(t, store, "Person", "p1", 1)
+
+	// the name is renamed to fullName in the schema version 2
+	store = New(user, testapp.AuthRoles, appInst)
+	store.Upcasters = NewUpcasters().Register("Person", "Created", 1, func(data []byte) ([]byte, error) {
+		return bytes.Replace(data, []byte(`"name"`), []byte(`"fullName"`), 1), nil
+	})
+	if err := store.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	current := testEvent("Person", "p2", 1)
+	current.Data = []byte(`{"fullName":"test"}`)
+	if err := store.Save([]core.Event{current}); err != nil {
+		t.Fatal(err)
+	}
+
+	events := fetchAll(t, store.All(context.Background(), 0, 0))
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(events))
+	}
+	for _, event := range events {
+		if string(event.Data) != `{"fullName":"test"}` {
+			t.Fatalf("expected the current shape, got %s", event.Data)
+		}
+		if _, version, _ := schemaVersionOf(&event); version != 2 {
+			t.Fatalf("expected schema version 2, got %d", version)
+		}
+	}
+}
+
+func TestConcurrentStore(t *testing.T) {
+	appInst, user := testapp.New(t)
+
+	store := New(user, testapp.AuthRoles, appInst)
+	if err := store.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func(aggId string) {
+			defer wg.Done()
+			if err := store.Save([]core.Event{testEvent("Person", aggId, 1)}); err != nil {
+				errs <- err
+				return
+			}
+			iterator, err := store.Get(context.Background(), aggId, "Person", 0)
+			if err != nil {
+				errs <- err
+				return
+			}
+			iterator.Close()
+		}(fmt.Sprintf("p%d", i))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	cached, err := store.GetOrCreateForAggType("Person")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a schema change reported by PocketBase invalidates the cached aggregate type
+	collection := cached.Collection
+	collection.Fields.Add(&pbcore.TextField{Name: "note"})
+	if err = appInst.Save(collection); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := store.GetOrCreateForAggType("Person")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded == cached || reloaded.Collection.Fields.GetByName("note") == nil {
+		t.Fatal("expected the aggregate type reloaded after the collection change")
+	}
+}
+
+func TestUniqueVersion(t *testing.T) {
+	appInst, user := testapp.New(t)
+
+	// a collection of an older version with the unique index on agg_id and required metadata
+	former := pbcore.NewBaseCollection("person")
+	former.Fields.Add(
+		&pbcore.TextField{Name: AggTypeFieldAggId, Required: true},
+		&pbcore.NumberField{Name: AggTypeFieldVersion, Required: true},
+		&pbcore.NumberField{Name: AggTypeFieldGlobalVersion, Required: true},
+		&pbcore.TextField{Name: AggTypeFieldReason, Required: true},
+		&pbcore.DateField{Name: AggTypeFieldTimestamp, Required: true},
+		&pbcore.JSONField{Name: AggTypeFieldMetadata, Required: true, MaxSize: PayloadMaxSize},
+	)
+	former.AddIndex("idx_person_agg_id", true, AggTypeFieldAggId, "")
+	if err := appInst.Save(former); err != nil {
+		t.Fatal(err)
+	}
+
+	store := New(user, testapp.AuthRoles, appInst)
+	if err := store.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	event := testEvent("Person", "p1", 1)
+	event.Metadata = nil
+	if err := store.Save([]core.Event{event, testEvent("Person", "p1", 2)}); err != nil {
+		t.Fatalf("expected the migrated collection to accept a stream, got %v", err)
+	}
+	if migrated, _ := appInst.FindCollectionByNameOrId("person"); migrated.GetIndex("idx_person_global_version") == "" {
+		t.Fatal("expected the global_version index on the migrated collection")
+	}
+
+	// the version check passes for the first event only, the duplicate is rejected by the unique index
+	duplicate := []core.Event{testEvent("Person", "p1", 3), testEvent("Person", "p1", 3)}
+	if err := store.Save(duplicate); !errors.Is(err, core.ErrConcurrency) {
+		t.Fatalf("expected concurrency error, got %v", err)
+	}
+}
+
+func TestAggregateTypesBackfill(t *testing.T) {
+	appInst, user := testapp.New(t)
+
+	store := New(user, testapp.AuthRoles, appInst)
+	if err := store.Load(); err != nil {
+		t.Fatal(err)
+	}
+	saveTestEvent(t, store, "OrderItem", "o1", 1)
+	saveTestEvent(t, store, "Person", "p1", 1)
+
+	// the collections were created before the registry existed
+	if err := appInst.Delete(store.AggregateTypes.Collection); err != nil {
+		t.Fatal(err)
+	}
+
+	store = New(user, testapp.AuthRoles, appInst)
+	if err := store.Load(); err != nil {
+		t.Fatal(err)
+	}
+	aggTypes, err := store.AggregateTypes.FindAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(aggTypes) != 2 || aggTypes["OrderItem"] != "order_item" || aggTypes["Person"] != "person" {
+		t.Fatalf("expected the aggregate collections registered, got %v", aggTypes)
+	}
+
+	events := fetchAll(t, store.All(context.Background(), 0, 0))
+	if len(events) != 2 || events[0].AggregateType != "OrderItem" || events[1].AggregateType != "Person" {
+		t.Fatalf("expected the events of the existing collections, got %v", events)
+	}
+
+	// the actual aggregate type replaces the derived one
+	if err = store.AggregateTypes.Register("orderItem", "order_item"); err != nil {
+		t.Fatal(err)
+	}
+	if aggTypes, err = store.AggregateTypes.FindAll(); err != nil {
+		t.Fatal(err)
+	}
+	if len(aggTypes) != 2 || aggTypes["orderItem"] != "order_item" {
+		t.Fatalf("expected the derived aggregate type replaced, got %v", aggTypes)
+	}
+}
+
+func TestMigrateStorage(t *testing.T) {
+	appInst, user := testapp.New(t)
+
+	store := New(user, testapp.AuthRoles, appInst)
+	if err := store.Load(); err != nil {
+		t.Fatal(err)
+	}
+	saveTestEvent(t, store, "Person", "p1", 1)
+	saveTestEvent(t, store, "Order", "o1", 1)
+	saveTestEvent(t, store, "Person", "p1", 2)
+	expected := fetchAll(t, store.All(context.Background(), 0, 0))
+
+	if count, err := store.MigrateStorage(context.Background(), StorageSingleCollection); err != nil || count != 3 {
+		t.Fatalf("expected 3 copied events, got %d, %v", count, err)
+	}
+
+	single := New(user, testapp.AuthRoles, appInst)
+	single.Storage = StorageSingleCollection
+	if err := single.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	events := fetchAll(t, single.All(context.Background(), 0, 0))
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events, got %d", len(expected), len(events))
+	}
+	for i := range events {
+		if events[i].AggregateType != expected[i].AggregateType || events[i].GlobalVersion != expected[i].GlobalVersion {
+			t.Fatalf("expected %v, got %v", expected[i], events[i])
+		}
+	}
+
+	// the streams continue in the new layout, separated by aggregate type
+	saveTestEvent(t, single, "Person", "p1", 3)
+	saveTestEvent(t, single, "Order", "p1", 1)
+	if err := single.Save([]core.Event{testEvent("Order", "o1", 1)}); !errors.Is(err, core.ErrConcurrency) {
+		t.Fatalf("expected concurrency error, got %v", err)
+	}
+
+	aggregate, err := single.GetOrCreateForAggType("Person")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count, _ := aggregate.CountEvents(); count != 3 {
+		t.Fatalf("expected 3 Person events, got %d", count)
+	}
+}
+
+func TestSharedAuthMigration(t *testing.T) {
+	appInst, user := testapp.New(t)
+
+	// the shared collections of an older version, the authorizations are keyed by agg_id only
+	former := NewSharedAggregate("", user, testapp.AuthRoles, db.NewSequence(appInst), appInst)
+	former.Auth = db.NewAuth(EventsColName, AggTypeFieldAggId, user, testapp.AuthRoles, appInst)
+	if err := former.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	store := New(user, testapp.AuthRoles, appInst)
+	store.Storage = StorageSingleCollection
+	if err := store.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	auth, err := appInst.FindCollectionByNameOrId("events_auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth.Fields.GetByName(AggTypeFieldAggType) == nil || auth.GetIndex("idx_events_auth_agg_id") != "" ||
+		auth.GetIndex("idx_events_auth_agg_type_agg_id") == "" {
+		t.Fatalf("expected the authorizations keyed by agg_type and agg_id, got %v", auth.Indexes)
+	}
+	events, err := appInst.FindCollectionByNameOrId(EventsColName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(*events.ListRule, "agg_type ?= @collection.events_auth.agg_type") {
+		t.Fatalf("expected the rules scoped by agg_type, got %v", *events.ListRule)
+	}
+}
+
+func TestMigrateStorageAuth(t *testing.T) {
+	appInst, user := testapp.New(t)
+
+	store := New(user, testapp.AuthRoles, appInst)
+	if err := store.Load(); err != nil {
+		t.Fatal(err)
+	}
+	saveTestEvent(t, store, "Person", "a1", 1)
+	saveTestEvent(t, store, "Order", "a1", 1)
+	saveAuthRecord(t, appInst, "person_auth", map[string]any{AggTypeFieldAggId: "a1"})
+	saveAuthRecord(t, appInst, "order_auth", map[string]any{AggTypeFieldAggId: "a1"})
+
+	// an authorization of the aggregate existing already in the target is not merged
+	single := New(user, testapp.AuthRoles, appInst)
+	single.Storage = StorageSingleCollection
+	if err := single.Load(); err != nil {
+		t.Fatal(err)
+	}
+	existing := saveAuthRecord(t, appInst, "events_auth", map[string]any{AggTypeFieldAggType: "Person", AggTypeFieldAggId: "a1"})
+	hooks := appInst.OnCollectionAfterUpdateSuccess().Length()
+	if _, err := store.MigrateStorage(context.Background(), StorageSingleCollection); err == nil {
+		t.Fatal("expected the migration to fail for an existing authorization")
+	}
+	// the registry is rolled back with the copy
+	if aggTypes, err := store.AggregateTypes.FindAll(); err != nil || aggTypes["Person"] != "person" {
+		t.Fatalf("expected the aggregate types of the former layout, got %v, %v", aggTypes, err)
+	}
+	if err := appInst.Delete(existing); err != nil {
+		t.Fatal(err)
+	}
+
+	// the same agg_id of both aggregate types is kept apart by the agg_type
+	if count, err := store.MigrateStorage(context.Background(), StorageSingleCollection); err != nil || count != 2 {
+		t.Fatalf("expected 2 copied events, got %d, %v", count, err)
+	}
+	if aggTypes, err := store.AggregateTypes.FindAll(); err != nil || aggTypes["Person"] != EventsColName {
+		t.Fatalf("expected the aggregate types of the new layout, got %v, %v", aggTypes, err)
+	}
+	if length := appInst.OnCollectionAfterUpdateSuccess().Length(); length != hooks {
+		t.Fatalf("expected no collection hooks bound by the migrations, got %d instead of %d", length, hooks)
+	}
+	for _, aggType := range []string{"Person", "Order"} {
+		if _, err := appInst.FindFirstRecordByFilter("events_auth", "agg_type = {:aggType} && agg_id = 'a1'",
+			map[string]any{"aggType": aggType}); err != nil {
+			t.Fatalf("expected the authorization of %v a1, got %v", aggType, err)
+		}
+	}
+}
+
+func TestSequenceBlocks(t *testing.T) {
+	appInst, user := testapp.New(t)
+	store := New(user, testapp.AuthRoles, appInst)
+	blocks := db.NewSequenceBlocks(store.Sequence, 10)
+	store.GlobalVersions = blocks
+	if err := store.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the block of a rolled back transaction is discarded
+	rollback := errors.New("rollback")
+	if err := appInst.RunInTransaction(func(txApp pbcore.App) error {
+		if _, err := blocks.GetNextMultipleTx(txApp, GlobalVersionSequence, 2); err != nil {
+			return err
+		}
+		return rollback
+	}); !errors.Is(err, rollback) {
+		t.Fatalf("expected rollback, got %v", err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		saveTestEvent(t, store, "Person", "p1", core.Version(i))
+	}
+	events := fetchAll(t, store.All(context.Background(), 0, 0))
+	if len(events) != 3 || events[0].GlobalVersion != 1 || events[2].GlobalVersion != 3 {
+		t.Fatalf("unexpected events %+v", events)
+	}
+
+	// only the block is reserved in the sequence record
+	if current, err := store.Sequence.Current(GlobalVersionSequence); err != nil || current != 10 {
+		t.Fatalf("expected current 10, got %v, %v", current, err)
+	}
+
+	// a request beyond the block reserves a new one
+	values, err := blocks.GetNextMultiple(GlobalVersionSequence, 12)
+	if err != nil || len(values) != 12 || values[0] != 11 || values[11] != 22 {
+		t.Fatalf("unexpected values %v, %v", values, err)
+	}
+
+	// setting the sequence forward discards the reserved block below the value
+	saveTestEvent(t, store, "Person", "p1", 4)
+	if err = store.SetSequence(GlobalVersionSequence, 100); err != nil {
+		t.Fatal(err)
+	}
+	saveTestEvent(t, store, "Person", "p1", 5)
+	if events = fetchAll(t, store.All(context.Background(), 23, 0)); len(events) != 1 || events[0].GlobalVersion != 101 {
+		t.Fatalf("expected the global version 101 after the set, got %+v", events)
+	}
+}
+
+func TestOnSaved(t *testing.T) {
+	appInst, user := testapp.New(t)
+	store := New(user, testapp.AuthRoles, appInst)
+	store.FastPath = true
+	if err := store.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	var saved [][]core.Event
+	unsubscribe := store.OnSaved(func(events []core.Event) {
+		saved = append(saved, events)
+	})
+
+	saveTestEvent(t, store, "Person", "p1", 1)
+	// the rolled back save is not reported
+	if err := store.Save([]core.Event{testEvent("Person", "p1", 1)}); !errors.Is(err, core.ErrConcurrency) {
+		t.Fatalf("expected concurrency error, got %v", err)
+	}
+	if len(saved) != 1 || len(saved[0]) != 1 || saved[0][0].GlobalVersion != 1 {
+		t.Fatalf("unexpected saved events %+v", saved)
+	}
+
+	unsubscribe()
+	saveTestEvent(t, store, "Person", "p1", 2)
+	if len(saved) != 1 {
+		t.Fatalf("expected no events after unsubscribe, got %+v", saved)
+	}
+}
+
+func testEvent(aggType string, aggId string, version core.Version) core.Event {
+	return core.Event{
+		AggregateID:   aggId,
+		AggregateType: aggType,
+		Version:       version,
+		Timestamp:     time.Now(),
+		Reason:        "Created",
+		Data:          []byte(`{"name":"test"}`),
+		Metadata:      []byte(`{"test":"hello"}`),
+	}
+}
+
+func saveAuthRecord(t *testing.T, appInst *testapp.Env, collection string, fields map[string]any) *pbcore.Record {
+	t.Helper()
+	coll, err := appInst.FindCollectionByNameOrId(collection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := pbcore.NewRecord(coll)
+	record.Load(fields)
+	if err = appInst.Save(record); err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+func saveTestEvent(t *testing.T, store *Store, aggType string, aggId string, version core.Version) {
+	t.Helper()
+	if err := store.Save([]core.Event{testEvent(aggType, aggId, version)}); err != nil {
+		t.Fatalf("Failed to save event: %v", err)
+	}
+}
+
+func fetchAll(t *testing.T, fetch Fetcher) (ret []core.Event) {
+	t.Helper()
+	iterator, err := fetch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iterator.Close()
+
+	for iterator.Next() {
+		var event core.Event
+		if event, err = iterator.Value(); err != nil {
+			t.Fatal(err)
+		}
+		ret = append(ret, event)
+	}
+	return
+}
+
+func BenchmarkSave(b *testing.B) {
+	for _, fastPath := range []bool{false, true} {
+		b.Run(benchmarkName(fastPath), func(b *testing.B) {
+			store := newBenchmarkStore(b, fastPath)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				events := make([]core.Event, 10)
+				for j := range events {
+					events[j] = testEvent("Person", fmt.Sprintf("p%d", i), core.Version(j+1))
+				}
+				if err := store.Save(events); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	for _, fastPath := range []bool{false, true} {
+		b.Run(benchmarkName(fastPath), func(b *testing.B) {
+			store := newBenchmarkStore(b, fastPath)
+
+			events := make([]core.Event, 100)
+			for j := range events {
+				events[j] = testEvent("Person", "p1", core.Version(j+1))
+			}
+			if err := store.Save(events); err != nil {
+				b.Fatal(err)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				iterator, err := store.Get(context.Background(), "p1", "Person", 0)
+				if err != nil {
+					b.Fatal(err)
+				}
+				for iterator.Next() {
+					if _, err = iterator.Value(); err != nil {
+						b.Fatal(err)
+					}
+				}
+				iterator.Close()
+			}
+		})
+	}
+}
+
+func benchmarkName(fastPath bool) string {
+	if fastPath {
+		return "fast"
+	}
+	return "record"
+}
+
+func newBenchmarkStore(b *testing.B, fastPath bool) (ret *Store) {
+	appInst, user := testapp.New(b)
+	ret = New(user, testapp.AuthRoles, appInst)
+	ret.FastPath = fastPath
+	if err := ret.Load(); err != nil {
+		b.Fatal(err)
+	}
+	return
 }
@@ -0,0 +1,124 @@
+package eventstore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/hallgren/eventsourcing/core"
+	"github.com/pocketbase/dbx"
+)
+
+const DefaultExportBatchSize = 1000
+
+// ExportSelection selects the exported events.
+// Without AggregateType all aggregate types are exported, AggregateID requires AggregateType.
+// The global version range is optional, a ToGlobalVersion of 0 means no upper bound.
+type ExportSelection struct {
+	AggregateType      string
+	AggregateID        string
+	AfterGlobalVersion core.Version
+	ToGlobalVersion    core.Version
+}
+
+// Export writes the selected events as newline-delimited JSON, see JSONEvent, in global_version order
+func (store *Store) Export(ctx context.Context, w io.Writer, selection ExportSelection) (count int, err error) {
+	var fetch Fetcher
+	if fetch, err = store.exportFetcher(ctx, selection); err != nil {
+		return
+	}
+
+	encoder := json.NewEncoder(w)
+	for {
+		var iterator core.Iterator
+		if iterator, err = fetch(); err != nil {
+			return
+		}
+
+		batchCount := 0
+		for iterator.Next() {
+			var event core.Event
+			if event, err = iterator.Value(); err != nil {
+				iterator.Close()
+				return
+			}
+			if selection.ToGlobalVersion > 0 && event.GlobalVersion > selection.ToGlobalVersion {
+				iterator.Close()
+				return
+			}
+			if err = encoder.Encode(NewJSONEvent(&event)); err != nil {
+				iterator.Close()
+				return
+			}
+			batchCount++
+			count++
+		}
+		iterator.Close()
+
+		if batchCount == 0 {
+			return
+		}
+	}
+}
+
+func (store *Store) exportFetcher(ctx context.Context, selection ExportSelection) (ret Fetcher, err error) {
+	if selection.AggregateType == "" {
+		if selection.AggregateID != "" {
+			err = fmt.Errorf("the export of aggregate %v needs the aggregate type", selection.AggregateID)
+			return
+		}
+		ret = store.All(ctx, selection.AfterGlobalVersion, DefaultExportBatchSize)
+		return
+	}
+
+	var exists bool
+	if exists, err = store.AggregateTypes.Exists(selection.AggregateType); err != nil || !exists {
+		// an unknown aggregate type has no events, it must not be created by the export
+		ret = func() (core.Iterator, error) { return NewEventsIterator(nil), err }
+		return
+	}
+
+	var aggregate *Aggregate
+	if aggregate, err = store.GetOrCreateForAggType(selection.AggregateType); err != nil {
+		return
+	}
+
+	if selection.AggregateID == "" {
+		after := selection.AfterGlobalVersion
+		ret = func() (iterator core.Iterator, fetchErr error) {
+			var events []core.Event
+			if events, fetchErr = aggregate.FindAfterGlobalVersion(ctx, after, DefaultExportBatchSize, nil); fetchErr != nil {
+				return
+			}
+			if len(events) > 0 {
+				after = events[len(events)-1].GlobalVersion
+			}
+			iterator = NewEventsIterator(events)
+			return
+		}
+		return
+	}
+
+	// the versions of an aggregate are in global_version order, so the stream is read by one iterator
+	done := false
+	ret = func() (iterator core.Iterator, fetchErr error) {
+		if done {
+			iterator = NewEventsIterator(nil)
+			return
+		}
+		done = true
+		iterator = NewIterator(ctx, aggregate, selection.AggregateID, 0, aggregate.PageSize).
+			WithFilter(afterGlobalVersionFilter(selection.AfterGlobalVersion))
+		return
+	}
+	return
+}
+
+func afterGlobalVersionFilter(afterGlobalVersion core.Version) QueryFilter {
+	return func(_ *Aggregate, query *dbx.SelectQuery) error {
+		query.AndWhere(dbx.NewExp(fmt.Sprintf("%v > {:%v}", AggTypeFieldGlobalVersion, AggTypeFieldGlobalVersion),
+			dbx.Params{AggTypeFieldGlobalVersion: uint64(afterGlobalVersion)}))
+		return nil
+	}
+}
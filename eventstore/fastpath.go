@@ -0,0 +1,231 @@
+package eventstore
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/hallgren/eventsourcing/core"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/tools/types"
+
+	pbcore "github.com/pocketbase/pocketbase/core"
+)
+
+// fastPathInsertRows limits the rows of one INSERT, so the bound parameters stay below the SQLite limit
+const fastPathInsertRows = 500
+
+// eventRow is an event record of the fast path, it is read and written without a pbcore.Record
+type eventRow struct {
+	AggType       string         `db:"agg_type"`
+	AggId         string         `db:"agg_id"`
+	Version       int64          `db:"version"`
+	GlobalVersion int64          `db:"global_version"`
+	Reason        string         `db:"reason"`
+	Timestamp     types.DateTime `db:"timestamp"`
+	Data          types.JSONRaw  `db:"data"`
+	Metadata      types.JSONRaw  `db:"metadata"`
+}
+
+// eventQuery returns a query over the events of the aggregate type, it is read by queryEvents
+func (o *Aggregate) eventQuery(app pbcore.App) (ret *dbx.SelectQuery) {
+	if !o.FastPath {
+		ret = o.RecordQuery(app)
+		return
+	}
+	ret = o.rowQuery(app.DB())
+	return
+}
+
+// rowQuery returns a query over the event rows of the aggregate type, it is read by queryRows
+func (o *Aggregate) rowQuery(builder dbx.Builder) (ret *dbx.SelectQuery) {
+	columns := []string{AggTypeFieldAggId, AggTypeFieldVersion, AggTypeFieldGlobalVersion,
+		AggTypeFieldReason, AggTypeFieldTimestamp, AggTypeFieldData, AggTypeFieldMetadata}
+	if o.Shared {
+		columns = append(columns, AggTypeFieldAggType)
+	}
+	for i, column := range columns {
+		columns[i] = fmt.Sprintf("[[%v.%v]]", o.Collection.Name, column)
+	}
+
+	ret = builder.Select(columns...).From(o.Collection.Name)
+	if o.Shared && o.AggregateType != "" {
+		ret.AndWhere(dbx.HashExp{o.column(AggTypeFieldAggType): o.AggregateType})
+	}
+	return
+}
+
+// queryEvents reads the events of a query created by eventQuery
+func (o *Aggregate) queryEvents(query *dbx.SelectQuery) (ret []core.Event, err error) {
+	if o.FastPath {
+		ret, err = o.queryRows(query)
+		return
+	}
+
+	var records []*pbcore.Record
+	if err = query.All(&records); err != nil {
+		return
+	}
+
+	ret = make([]core.Event, len(records))
+	for i, record := range records {
+		var event *core.Event
+		if event, err = o.newEvent(record); err != nil {
+			return
+		}
+		ret[i] = *event
+	}
+	return
+}
+
+// queryRows reads the events of a query created by rowQuery
+func (o *Aggregate) queryRows(query *dbx.SelectQuery) (ret []core.Event, err error) {
+	var rows []eventRow
+	if err = query.All(&rows); err != nil {
+		return
+	}
+
+	ret = make([]core.Event, len(rows))
+	for i := range rows {
+		if err = o.rowEvent(&rows[i], &ret[i]); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// FindAfterVersionTx returns all events of the aggregate after the version, read with the builder,
+// e.g. within db.RunInReadTransaction
+func (o *Aggregate) FindAfterVersionTx(
+	ctx context.Context, tx dbx.Builder, aggId string, afterVersion core.Version) (ret []core.Event, err error) {
+
+	ret, err = o.queryRows(o.rowQuery(tx).
+		WithContext(ctx).
+		AndWhere(dbx.HashExp{AggTypeFieldAggId: aggId}).
+		AndWhere(dbx.NewExp(fmt.Sprintf("%v > {:%v}", AggTypeFieldVersion, AggTypeFieldVersion),
+			dbx.Params{AggTypeFieldVersion: uint64(afterVersion)})).
+		OrderBy(AggTypeFieldVersion + " ASC"))
+	return
+}
+
+func (o *Aggregate) rowEvent(row *eventRow, event *core.Event) (err error) {
+	*event = core.Event{
+		AggregateID:   row.AggId,
+		Version:       core.Version(row.Version),
+		GlobalVersion: core.Version(row.GlobalVersion),
+		AggregateType: o.AggregateType,
+		Reason:        row.Reason,
+		Timestamp:     row.Timestamp.Time(),
+	}
+	if o.Shared {
+		event.AggregateType = row.AggType
+	}
+
+	if event.Data, err = decodePayload(row.Data); err != nil {
+		return
+	}
+	if event.Metadata, err = decodePayload(row.Metadata); err != nil {
+		return
+	}
+	err = openEvent(event, o.Keys, o.Upcasters)
+	return
+}
+
+// insertRowsTx writes the events with multi-row INSERTs, without the validation and hooks of PocketBase records.
+// The INSERT of a batch size is prepared once, so the full batches of a large save reuse the statement.
+func (o *Aggregate) insertRowsTx(txApp pbcore.App, stream *streamEvents) (err error) {
+	statements := map[int]*dbx.Query{}
+	defer func() {
+		for _, statement := range statements {
+			_ = statement.Close()
+		}
+	}()
+
+	for start := 0; start < len(stream.events); start += fastPathInsertRows {
+		end := min(start+fastPathInsertRows, len(stream.events))
+
+		params := dbx.Params{}
+		for i := start; i < end; i++ {
+			var row []any
+			if row, err = o.rowValuesTx(txApp, stream.events[i], stream.eventIds[i]); err != nil {
+				return
+			}
+			for j, value := range row {
+				params[fmt.Sprintf("p%d_%d", i-start, j)] = value
+			}
+		}
+
+		statement := statements[end-start]
+		if statement == nil {
+			statement = txApp.DB().NewQuery(o.insertRowsSQL(end - start)).Prepare()
+			statements[end-start] = statement
+		}
+		if _, err = statement.Bind(params).Execute(); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// insertRowsSQL returns the INSERT of rows events, the parameters are named p<row>_<column>
+func (o *Aggregate) insertRowsSQL(rows int) (ret string) {
+	columns := []string{pbcore.FieldNameId, AggTypeFieldAggId, AggTypeFieldVersion, AggTypeFieldGlobalVersion,
+		AggTypeFieldReason, AggTypeFieldTimestamp, AggTypeFieldData, AggTypeFieldMetadata, AggTypeFieldEventId}
+	if o.Shared {
+		columns = append(columns, AggTypeFieldAggType)
+	}
+
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = "[[" + column + "]]"
+	}
+
+	values := make([]string, rows)
+	for i := range values {
+		placeholders := make([]string, len(columns))
+		for j := range columns {
+			placeholders[j] = fmt.Sprintf("{:p%d_%d}", i, j)
+		}
+		values[i] = "(" + strings.Join(placeholders, ", ") + ")"
+	}
+	ret = fmt.Sprintf("INSERT INTO {{%v}} (%v) VALUES %v",
+		o.Collection.Name, strings.Join(quoted, ", "), strings.Join(values, ", "))
+	return
+}
+
+// rowValuesTx returns the column values of the event in the order of insertRowsTx
+func (o *Aggregate) rowValuesTx(txApp pbcore.App, event *core.Event, eventId string) (ret []any, err error) {
+	var data, metadata []byte
+	if data, err = encodePayload(o.Codec, event.Data); err != nil {
+		return
+	}
+	if metadata, err = encodePayload(o.Codec, event.Metadata); err != nil {
+		return
+	}
+	if o.Keys != nil {
+		if data, err = o.Keys.EncryptTx(txApp, event.AggregateType, event.AggregateID, data); err != nil {
+			return
+		}
+	}
+
+	var timestamp types.DateTime
+	if timestamp, err = types.ParseDateTime(event.Timestamp); err != nil {
+		return
+	}
+
+	ret = []any{
+		pbcore.GenerateDefaultRandomId(),
+		event.AggregateID,
+		uint64(event.Version),
+		uint64(event.GlobalVersion),
+		event.Reason,
+		timestamp,
+		types.JSONRaw(data),
+		types.JSONRaw(metadata),
+		eventId,
+	}
+	if o.Shared {
+		ret = append(ret, event.AggregateType)
+	}
+	return
+}
@@ -0,0 +1,229 @@
+package eventstore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/go-ee/eventsoutcing_pocketbase/db"
+	"github.com/hallgren/eventsourcing/core"
+
+	pbcore "github.com/pocketbase/pocketbase/core"
+)
+
+// ErrImportDryRun rolls back the transaction of a dry-run import
+var ErrImportDryRun = errors.New("import dry-run")
+
+type ImportOptions struct {
+	// DryRun verifies the import completely and rolls it back
+	DryRun bool
+}
+
+type ImportResult struct {
+	Count              int
+	AggregateTypes     map[string]int
+	FirstGlobalVersion core.Version
+	LastGlobalVersion  core.Version
+}
+
+// Import replays newline-delimited JSON events, as written by Export, into the store.
+// The version and global_version of the events are preserved and the global version sequence is advanced.
+// The versions of each aggregate must continue its stored stream and the global versions must be ascending
+// and beyond the global version sequence of the store, otherwise the import fails with core.ErrConcurrency.
+// The import runs in one transaction, either all events are imported or none.
+func (store *Store) Import(ctx context.Context, r io.Reader, options ImportOptions) (ret *ImportResult, err error) {
+	ret = &ImportResult{AggregateTypes: map[string]int{}}
+	err = store.App().RunInTransaction(func(txApp pbcore.App) (txErr error) {
+		var lastGlobalVersion int
+		if lastGlobalVersion, txErr = store.Sequence.CurrentTx(txApp, GlobalVersionSequence); txErr != nil {
+			return
+		}
+
+		importer := &importer{
+			store:             store,
+			txApp:             txApp,
+			lastGlobalVersion: core.Version(lastGlobalVersion),
+			lastVersions:      map[string]core.Version{},
+			aggregates:        map[string]*Aggregate{},
+			result:            ret,
+		}
+		if txErr = importer.importAll(ctx, r); txErr != nil {
+			return
+		}
+
+		if ret.Count > 0 {
+			if txErr = store.Sequence.AdvanceTx(txApp, GlobalVersionSequence, int(ret.LastGlobalVersion)); txErr != nil {
+				return
+			}
+		}
+
+		if options.DryRun {
+			txErr = ErrImportDryRun
+		}
+		return
+	})
+
+	if options.DryRun && errors.Is(err, ErrImportDryRun) {
+		err = nil
+	} else if err == nil && ret.Count > 0 {
+		// the reserved blocks are below the imported global versions
+		store.resetGlobalVersions(GlobalVersionSequence)
+	}
+	return
+}
+
+type importer struct {
+	store             *Store
+	txApp             pbcore.App
+	lastGlobalVersion core.Version
+	// lastVersions are the latest versions of the imported aggregates, keyed by aggregate type and id
+	lastVersions map[string]core.Version
+	// aggregates are the aggregate types of the import, new ones are created within the transaction
+	aggregates map[string]*Aggregate
+	result     *ImportResult
+}
+
+// aggregateTx returns the aggregate type, a new one is created within the transaction,
+// so a failed or dry-run import leaves no collections behind
+func (o *importer) aggregateTx(aggType string) (ret *Aggregate, err error) {
+	if ret = o.aggregates[aggType]; ret != nil {
+		return
+	}
+
+	var exists bool
+	if exists, err = o.store.AggregateTypes.Exists(aggType); err != nil {
+		return
+	}
+
+	if exists {
+		ret, err = o.store.GetOrCreateForAggType(aggType)
+	} else {
+		ret = o.store.newAggregate(aggType, &txEnv{Env: o.store.Env, txApp: o.txApp})
+		if err = ret.Load(); err != nil {
+			return
+		}
+		err = o.store.AggregateTypes.RegisterTx(o.txApp, aggType, ret.Name)
+	}
+
+	if err == nil {
+		o.aggregates[aggType] = ret
+	}
+	return
+}
+
+// txEnv is the environment of collections loaded within a transaction
+type txEnv struct {
+	db.Env
+	txApp pbcore.App
+}
+
+func (o *txEnv) App() pbcore.App {
+	return o.txApp
+}
+
+func (o *importer) importAll(ctx context.Context, r io.Reader) (err error) {
+	// the lines are not limited, the exported data is decoded and may exceed the payload size of the store
+	reader := bufio.NewReader(r)
+
+	line := 0
+	for {
+		var data []byte
+		data, err = reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return
+		}
+		eof := err == io.EOF
+		err = nil
+
+		line++
+		if data = trimLine(data); len(data) > 0 {
+			if err = ctx.Err(); err != nil {
+				return
+			}
+
+			item := JSONEvent{}
+			if err = json.Unmarshal(data, &item); err != nil {
+				err = fmt.Errorf("line %d: %w", line, err)
+				return
+			}
+
+			event := item.Event()
+			if err = o.importEvent(&event); err != nil {
+				err = fmt.Errorf("line %d: %w", line, err)
+				return
+			}
+		}
+
+		if eof {
+			return
+		}
+	}
+}
+
+// trimLine removes the line ending
+func trimLine(line []byte) []byte {
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	return bytes.TrimSuffix(line, []byte("\r"))
+}
+
+func (o *importer) importEvent(event *core.Event) (err error) {
+	if event.AggregateType == "" || event.AggregateID == "" {
+		err = fmt.Errorf("aggregate type and id are required")
+		return
+	}
+
+	if event.GlobalVersion <= o.lastGlobalVersion {
+		err = fmt.Errorf("%w: global version %d is not after %d",
+			core.ErrConcurrency, event.GlobalVersion, o.lastGlobalVersion)
+		return
+	}
+
+	var aggregate *Aggregate
+	if aggregate, err = o.aggregateTx(event.AggregateType); err != nil {
+		return
+	}
+
+	key := event.AggregateType + "/" + event.AggregateID
+	lastVersion, ok := o.lastVersions[key]
+	if !ok {
+		if lastVersion, err = aggregate.latestVersionTx(o.txApp, event.AggregateID); err != nil {
+			return
+		}
+	}
+	if event.Version != lastVersion+1 {
+		err = fmt.Errorf("%w: version %d of %v does not follow %d",
+			core.ErrConcurrency, event.Version, key, lastVersion)
+		return
+	}
+
+	var eventId string
+	if eventId, err = EventIdOf(event); err != nil {
+		return
+	}
+
+	var record *pbcore.Record
+	if record, err = aggregate.newRecordTx(o.txApp, event, eventId); err != nil {
+		return
+	}
+	if err = o.txApp.Save(record); err != nil {
+		if isUniqueViolation(err) {
+			err = fmt.Errorf("%w: %v", core.ErrConcurrency, err)
+		}
+		return
+	}
+
+	o.lastVersions[key] = event.Version
+	o.lastGlobalVersion = event.GlobalVersion
+
+	if o.result.Count == 0 {
+		o.result.FirstGlobalVersion = event.GlobalVersion
+	}
+	o.result.LastGlobalVersion = event.GlobalVersion
+	o.result.AggregateTypes[event.AggregateType]++
+	o.result.Count++
+	return
+}
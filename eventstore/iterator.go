@@ -1,39 +1,134 @@
 package eventstore
 
 import (
+	"context"
+	"fmt"
+
 	"github.com/hallgren/eventsourcing/core"
-	pbcore "github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/dbx"
 )
 
-func NewIterator(aggregateType string, records []*pbcore.Record) *Iterator {
+const DefaultPageSize = 500
+
+// NewIterator creates an iterator over the events of one aggregate after the given version.
+// The events are fetched lazily page by page, ordered by version.
+func NewIterator(ctx context.Context, aggregate *Aggregate, aggId string, afterVersion core.Version, pageSize int) *Iterator {
+	if pageSize <= 0 {
+		pageSize = DefaultPageSize
+	}
 	return &Iterator{
-		aggregateType: aggregateType,
-		records:       records,
-		recordsCount:  len(records),
+		ctx:          ctx,
+		aggregate:    aggregate,
+		aggId:        aggId,
+		lastVersion:  afterVersion,
+		pageSize:     pageSize,
+		currentIndex: -1,
 	}
 }
 
 type Iterator struct {
-	aggregateType string
-	records       []*pbcore.Record
-	currentIndex  int
-	recordsCount  int
+	ctx          context.Context
+	aggregate    *Aggregate
+	aggId        string
+	lastVersion  core.Version
+	pageSize     int
+	events       []core.Event
+	currentIndex int
+	lastPage     bool
+	closed       bool
+	err          error
+	filter       QueryFilter
+}
+
+// WithFilter restricts the fetched events, e.g. by access rules
+func (i *Iterator) WithFilter(filter QueryFilter) *Iterator {
+	i.filter = filter
+	return i
 }
 
-// Next return true if there are more data
+// Next return true if there are more data.
+// A failing page fetch returns true as well, so the error is reported by Value.
 func (i *Iterator) Next() bool {
+	if i.closed {
+		return false
+	}
+
 	i.currentIndex++
-	return i.currentIndex < i.recordsCount
+	if i.currentIndex < len(i.events) {
+		return true
+	}
+
+	if i.lastPage {
+		i.Close()
+		return false
+	}
+
+	if i.err = i.fetchPage(); i.err != nil {
+		return true
+	}
+
+	if len(i.events) == 0 {
+		i.Close()
+		return false
+	}
+	return true
 }
 
 // Value return the event
 func (i *Iterator) Value() (ret core.Event, err error) {
-	currentRecord := i.records[i.currentIndex]
-	ret = *NewEvent(currentRecord, i.aggregateType)
+	if i.err != nil {
+		err = i.err
+		i.Close()
+		return
+	}
+
+	if i.closed || i.currentIndex < 0 || i.currentIndex >= len(i.events) {
+		err = fmt.Errorf("iterator has no current event")
+		return
+	}
+
+	ret = i.events[i.currentIndex]
 	return
 }
 
 // Close closes the iterator
 func (i *Iterator) Close() {
-	i.records = nil
+	i.closed = true
+	i.events = nil
+}
+
+func (i *Iterator) fetchPage() (err error) {
+	// release the previous page before loading the next one
+	i.events = nil
+	i.currentIndex = 0
+
+	if err = i.ctx.Err(); err != nil {
+		return
+	}
+
+	query := i.aggregate.eventQuery(i.aggregate.App()).
+		WithContext(i.ctx).
+		AndWhere(dbx.HashExp{i.aggregate.column(AggTypeFieldAggId): i.aggId}).
+		AndWhere(dbx.NewExp(fmt.Sprintf("%v > {:%v}", AggTypeFieldVersion, AggTypeFieldVersion),
+			dbx.Params{AggTypeFieldVersion: uint64(i.lastVersion)})).
+		OrderBy(AggTypeFieldVersion + " ASC").
+		Limit(int64(i.pageSize))
+
+	if i.filter != nil {
+		if err = i.filter(i.aggregate, query); err != nil {
+			return
+		}
+	}
+
+	if i.events, err = i.aggregate.queryEvents(query); err != nil {
+		return
+	}
+
+	if len(i.events) < i.pageSize {
+		i.lastPage = true
+	}
+	if len(i.events) > 0 {
+		i.lastVersion = i.events[len(i.events)-1].Version
+	}
+	return
 }
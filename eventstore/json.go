@@ -0,0 +1,62 @@
+package eventstore
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/hallgren/eventsourcing/core"
+)
+
+// JSONEvent is the JSON representation of core.Event with Data and Metadata embedded as raw JSON
+type JSONEvent struct {
+	AggregateID   string          `json:"aggregateId"`
+	AggregateType string          `json:"aggregateType"`
+	Version       core.Version    `json:"version"`
+	GlobalVersion core.Version    `json:"globalVersion"`
+	Reason        string          `json:"reason"`
+	Timestamp     time.Time       `json:"timestamp"`
+	Data          json.RawMessage `json:"data,omitempty"`
+	Metadata      json.RawMessage `json:"metadata,omitempty"`
+}
+
+func NewJSONEvent(event *core.Event) *JSONEvent {
+	return &JSONEvent{
+		AggregateID:   event.AggregateID,
+		AggregateType: event.AggregateType,
+		Version:       event.Version,
+		GlobalVersion: event.GlobalVersion,
+		Reason:        event.Reason,
+		Timestamp:     event.Timestamp,
+		Data:          rawJSON(event.Data),
+		Metadata:      rawJSON(event.Metadata),
+	}
+}
+
+func (o *JSONEvent) Event() core.Event {
+	return core.Event{
+		AggregateID:   o.AggregateID,
+		AggregateType: o.AggregateType,
+		Version:       o.Version,
+		GlobalVersion: o.GlobalVersion,
+		Reason:        o.Reason,
+		Timestamp:     o.Timestamp,
+		Data:          o.Data,
+		Metadata:      o.Metadata,
+	}
+}
+
+func NewJSONEvents(events []core.Event) (ret []*JSONEvent) {
+	ret = make([]*JSONEvent, len(events))
+	for i := range events {
+		ret[i] = NewJSONEvent(&events[i])
+	}
+	return
+}
+
+// rawJSON returns nil for empty or invalid JSON, so the event can always be marshalled
+func rawJSON(data []byte) json.RawMessage {
+	if len(data) == 0 || !json.Valid(data) {
+		return nil
+	}
+	return data
+}
@@ -0,0 +1,100 @@
+package eventstore
+
+import (
+	"container/list"
+	"crypto/cipher"
+	"sync"
+	"time"
+)
+
+const DefaultKeyCacheSize = 1000
+
+// DefaultKeyCacheTTL bounds how long a key destroyed by another process stays readable
+const DefaultKeyCacheTTL = 5 * time.Second
+
+// keyCache keeps the unwrapped data keys of the recently read aggregates (LRU),
+// so reading the events of an aggregate queries and unwraps its key once per ttl.
+// A nil cipher is cached for a destroyed key.
+type keyCache struct {
+	mu      sync.Mutex
+	entries map[keyCacheKey]*list.Element
+	order   list.List
+	// removals invalidates the keys looked up before a removal, they may be stale
+	removals uint64
+}
+
+type keyCacheKey struct {
+	aggType string
+	aggId   string
+}
+
+type keyCacheEntry struct {
+	key     keyCacheKey
+	aead    cipher.AEAD
+	expires time.Time
+}
+
+func (o *keyCache) get(aggType string, aggId string) (ret cipher.AEAD, ok bool, removals uint64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	removals = o.removals
+	var element *list.Element
+	if element, ok = o.entries[keyCacheKey{aggType: aggType, aggId: aggId}]; !ok {
+		return
+	}
+
+	entry := element.Value.(*keyCacheEntry)
+	if time.Now().After(entry.expires) {
+		// the key may be destroyed meanwhile, it is looked up again
+		o.order.Remove(element)
+		delete(o.entries, entry.key)
+		ok = false
+		return
+	}
+	o.order.MoveToFront(element)
+	ret = entry.aead
+	return
+}
+
+// put caches the key for ttl, unless a key was removed since the lookup returning removals
+func (o *keyCache) put(aggType string, aggId string, aead cipher.AEAD, removals uint64, size int, ttl time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if size <= 0 || ttl <= 0 || removals != o.removals {
+		return
+	}
+	if o.entries == nil {
+		o.entries = map[keyCacheKey]*list.Element{}
+	}
+
+	key := keyCacheKey{aggType: aggType, aggId: aggId}
+	expires := time.Now().Add(ttl)
+	if element, ok := o.entries[key]; ok {
+		entry := element.Value.(*keyCacheEntry)
+		entry.aead = aead
+		entry.expires = expires
+		o.order.MoveToFront(element)
+		return
+	}
+
+	o.entries[key] = o.order.PushFront(&keyCacheEntry{key: key, aead: aead, expires: expires})
+	for o.order.Len() > size {
+		oldest := o.order.Back()
+		o.order.Remove(oldest)
+		delete(o.entries, oldest.Value.(*keyCacheEntry).key)
+	}
+}
+
+func (o *keyCache) remove(aggType string, aggId string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.removals++
+	key := keyCacheKey{aggType: aggType, aggId: aggId}
+	if element, ok := o.entries[key]; ok {
+		o.order.Remove(element)
+		delete(o.entries, key)
+	}
+}
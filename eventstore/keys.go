@@ -0,0 +1,351 @@
+package eventstore
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-ee/eventsoutcing_pocketbase/db"
+	"github.com/hallgren/eventsourcing/core"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/tools/types"
+
+	pbcore "github.com/pocketbase/pocketbase/core"
+)
+
+const KeysColName = "aggregate_keys"
+const KeysFieldAggType = "agg_type"
+const KeysFieldKey = "key"
+const KeysFieldDestroyedAt = "destroyed_at"
+
+const EncryptionAES256GCM = "A256GCM"
+
+// encryptionHeader starts the JSON envelope of an encrypted payload
+var encryptionHeader = []byte(`{"$enc":`)
+
+// RedactedData is the Data of events, whose aggregate key is destroyed
+var RedactedData = []byte(`{"$redacted":true}`)
+
+// ErrKeyDestroyed is returned when saving events of an aggregate with a destroyed key
+var ErrKeyDestroyed = errors.New("the key of the aggregate is destroyed")
+
+// IsRedacted returns true, if the data of the event is not readable anymore
+func IsRedacted(event *core.Event) bool {
+	return bytes.Equal(event.Data, RedactedData)
+}
+
+func NewKeys(env db.Env) *Keys {
+	return &Keys{
+		CollectionBase: db.CollectionBase{Name: KeysColName, Env: env},
+		CacheSize:      DefaultKeyCacheSize,
+		CacheTTL:       DefaultKeyCacheTTL,
+	}
+}
+
+// Keys encrypts the Data of events with a data key per aggregate.
+// The data keys are stored wrapped by the master key of the db.MasterKeyEnv.
+// Destroying the key of an aggregate makes its events unreadable without rewriting them (crypto-shredding).
+type Keys struct {
+	db.CollectionBase
+	// CacheSize is the number of unwrapped keys kept for reading, 0 disables the cache.
+	CacheSize int
+	// CacheTTL is how long an unwrapped key is kept, 0 disables the cache.
+	// A key destroyed by another process stays readable in this process until its entry expires.
+	CacheTTL time.Duration
+
+	master cipher.AEAD
+	cache  keyCache
+}
+
+func (o *Keys) Load() (err error) {
+	keyEnv, ok := o.Env.(db.MasterKeyEnv)
+	if !ok {
+		err = fmt.Errorf("encryption needs an env supplying the master key")
+		return
+	}
+	if o.master, err = newAEAD(keyEnv.MasterKey()); err != nil {
+		err = fmt.Errorf("master key: %w", err)
+		return
+	}
+
+	if o.Collection != nil && !o.IsRecreateDb() {
+		return
+	}
+
+	dao := o.App()
+	if o.Collection, err = dao.FindCollectionByNameOrId(o.Name); o.Collection == nil || o.IsRecreateDb() {
+		if o.Collection != nil {
+			if err = dao.Delete(o.Collection); err != nil {
+				return
+			}
+		}
+
+		o.Collection = pbcore.NewBaseCollection(o.Name)
+		o.Collection.Fields.Add(
+			&pbcore.TextField{
+				Name:     KeysFieldAggType,
+				Required: true,
+			},
+			&pbcore.TextField{
+				Name:     AggTypeFieldAggId,
+				Required: true,
+			},
+			&pbcore.TextField{
+				Name: KeysFieldKey,
+			},
+			&pbcore.DateField{
+				Name: KeysFieldDestroyedAt,
+			},
+		)
+
+		indexName := fmt.Sprintf("idx_%v_%v_%v", o.Name, KeysFieldAggType, AggTypeFieldAggId)
+		o.Collection.AddIndex(indexName, true, fmt.Sprintf("%v, %v", KeysFieldAggType, AggTypeFieldAggId), "")
+
+		err = dao.Save(o.Collection)
+	}
+	return
+}
+
+// EncryptTx encrypts the data with the key of the aggregate, a missing key is created
+func (o *Keys) EncryptTx(txApp pbcore.App, aggType string, aggId string, data []byte) (ret []byte, err error) {
+	if len(data) == 0 {
+		ret = data
+		return
+	}
+
+	var record *pbcore.Record
+	if record, err = o.find(txApp, aggType, aggId); err != nil {
+		return
+	}
+	if record == nil {
+		if record, err = o.createTx(txApp, aggType, aggId); err != nil {
+			return
+		}
+	}
+
+	var aead cipher.AEAD
+	if aead, err = o.unwrap(record); err != nil {
+		return
+	}
+	if aead == nil {
+		err = fmt.Errorf("%w: %v %v", ErrKeyDestroyed, aggType, aggId)
+		return
+	}
+
+	var sealed []byte
+	if sealed, err = seal(aead, data); err != nil {
+		return
+	}
+	ret, err = json.Marshal(encryptedPayload{Encryption: EncryptionAES256GCM, Payload: sealed})
+	return
+}
+
+// Decrypt decrypts the data with the key of the aggregate, it returns RedactedData, if the key is destroyed.
+// Data not encrypted is returned as is.
+func (o *Keys) Decrypt(aggType string, aggId string, data []byte) (ret []byte, err error) {
+	ret = data
+	if !bytes.HasPrefix(data, encryptionHeader) {
+		return
+	}
+
+	var envelope encryptedPayload
+	if err = json.Unmarshal(data, &envelope); err != nil {
+		return
+	}
+	if envelope.Encryption != EncryptionAES256GCM {
+		err = fmt.Errorf("unknown encryption %v", envelope.Encryption)
+		return
+	}
+
+	var aead cipher.AEAD
+	if aead, err = o.decryptionKey(aggType, aggId); err != nil {
+		return
+	}
+	if aead == nil {
+		ret = RedactedData
+		return
+	}
+	ret, err = open(aead, envelope.Payload)
+	return
+}
+
+// decryptionKey returns the cached cipher of the aggregate, nil if its key is destroyed or missing
+func (o *Keys) decryptionKey(aggType string, aggId string) (ret cipher.AEAD, err error) {
+	ret, cached, removals := o.cache.get(aggType, aggId)
+	if cached {
+		return
+	}
+
+	var record *pbcore.Record
+	if record, err = o.find(o.App(), aggType, aggId); err != nil || record == nil {
+		return
+	}
+	if ret, err = o.unwrap(record); err != nil {
+		return
+	}
+	o.cache.put(aggType, aggId, ret, removals, o.CacheSize, o.CacheTTL)
+	return
+}
+
+// Destroy removes the key of the aggregate, its events are redacted afterwards and new events are rejected
+func (o *Keys) Destroy(aggType string, aggId string) (err error) {
+	err = o.App().RunInTransaction(func(txApp pbcore.App) (txErr error) {
+		var record *pbcore.Record
+		if record, txErr = o.find(txApp, aggType, aggId); txErr != nil {
+			return
+		}
+		if record == nil {
+			record = pbcore.NewRecord(o.Collection)
+			record.Set(KeysFieldAggType, aggType)
+			record.Set(AggTypeFieldAggId, aggId)
+		}
+		record.Set(KeysFieldKey, "")
+		record.Set(KeysFieldDestroyedAt, time.Now())
+		txErr = txApp.Save(record)
+		return
+	})
+	o.cache.remove(aggType, aggId)
+	return
+}
+
+// IsDestroyed returns true, if the key of the aggregate is destroyed
+func (o *Keys) IsDestroyed(aggType string, aggId string) (ret bool, err error) {
+	var record *pbcore.Record
+	if record, err = o.find(o.App(), aggType, aggId); err != nil || record == nil {
+		return
+	}
+	ret = !record.GetDateTime(KeysFieldDestroyedAt).IsZero()
+	return
+}
+
+// decryptEvent replaces the Data of the event by the decrypted and decoded data
+func (o *Keys) decryptEvent(event *core.Event) (err error) {
+	if !bytes.HasPrefix(event.Data, encryptionHeader) {
+		return
+	}
+
+	var data []byte
+	if data, err = o.Decrypt(event.AggregateType, event.AggregateID, event.Data); err != nil {
+		return
+	}
+	if bytes.Equal(data, RedactedData) {
+		event.Data = RedactedData
+		return
+	}
+	event.Data, err = decodePayload(data)
+	return
+}
+
+// encryptRecordTx encrypts the already encoded data of the event record
+func (o *Keys) encryptRecordTx(txApp pbcore.App, record *pbcore.Record, event *core.Event) (err error) {
+	var data []byte
+	encoded := record.Get(AggTypeFieldData).(types.JSONRaw)
+	if data, err = o.EncryptTx(txApp, event.AggregateType, event.AggregateID, encoded); err != nil {
+		return
+	}
+	record.Set(AggTypeFieldData, data)
+	return
+}
+
+// find returns the key record of the aggregate, nil if it has none
+func (o *Keys) find(txApp pbcore.App, aggType string, aggId string) (ret *pbcore.Record, err error) {
+	var record pbcore.Record
+	if err = txApp.RecordQuery(o.Collection).
+		AndWhere(dbx.HashExp{KeysFieldAggType: aggType, AggTypeFieldAggId: aggId}).
+		Limit(1).
+		One(&record); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = nil
+		}
+		return
+	}
+	ret = &record
+	return
+}
+
+func (o *Keys) createTx(txApp pbcore.App, aggType string, aggId string) (ret *pbcore.Record, err error) {
+	dataKey := make([]byte, 32)
+	if _, err = rand.Read(dataKey); err != nil {
+		return
+	}
+
+	var wrapped []byte
+	if wrapped, err = seal(o.master, dataKey); err != nil {
+		return
+	}
+
+	ret = pbcore.NewRecord(o.Collection)
+	ret.Set(KeysFieldAggType, aggType)
+	ret.Set(AggTypeFieldAggId, aggId)
+	ret.Set(KeysFieldKey, base64.StdEncoding.EncodeToString(wrapped))
+	err = txApp.Save(ret)
+	return
+}
+
+// unwrap returns the cipher of the data key, nil if the key is destroyed
+func (o *Keys) unwrap(record *pbcore.Record) (ret cipher.AEAD, err error) {
+	encoded := record.GetString(KeysFieldKey)
+	if encoded == "" {
+		return
+	}
+
+	var wrapped []byte
+	if wrapped, err = base64.StdEncoding.DecodeString(encoded); err != nil {
+		return
+	}
+
+	var dataKey []byte
+	if dataKey, err = open(o.master, wrapped); err != nil {
+		err = fmt.Errorf("unwrap the key of %v %v: %w",
+			record.GetString(KeysFieldAggType), record.GetString(AggTypeFieldAggId), err)
+		return
+	}
+	ret, err = newAEAD(dataKey)
+	return
+}
+
+// encryptedPayload is the JSON envelope of an encrypted payload, so it fits into the JSON fields
+type encryptedPayload struct {
+	Encryption string `json:"$enc"`
+	Payload    []byte `json:"payload"`
+}
+
+func newAEAD(key []byte) (ret cipher.AEAD, err error) {
+	if len(key) != 32 {
+		err = fmt.Errorf("the key must have 32 bytes, got %d", len(key))
+		return
+	}
+
+	var block cipher.Block
+	if block, err = aes.NewCipher(key); err != nil {
+		return
+	}
+	ret, err = cipher.NewGCM(block)
+	return
+}
+
+// seal encrypts the data with a random nonce, the nonce is prepended to the result
+func seal(aead cipher.AEAD, data []byte) (ret []byte, err error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err = rand.Read(nonce); err != nil {
+		return
+	}
+	ret = aead.Seal(nonce, nonce, data, nil)
+	return
+}
+
+func open(aead cipher.AEAD, data []byte) (ret []byte, err error) {
+	if len(data) < aead.NonceSize() {
+		err = fmt.Errorf("encrypted data too short")
+		return
+	}
+	ret, err = aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	return
+}
@@ -0,0 +1,360 @@
+package eventstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-ee/eventsoutcing_pocketbase/db"
+	"github.com/hallgren/eventsourcing/core"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/tools/types"
+
+	pbcore "github.com/pocketbase/pocketbase/core"
+)
+
+const OutboxColName = "outbox"
+const OutboxFieldAggType = "agg_type"
+const OutboxFieldDelivered = "delivered"
+const OutboxFieldDeliveredAt = "delivered_at"
+const OutboxFieldAttempts = "attempts"
+const OutboxFieldNextAttempt = "next_attempt"
+const OutboxFieldLastError = "last_error"
+
+const DefaultOutboxBatchSize = 100
+const DefaultOutboxPollInterval = time.Second
+const DefaultOutboxMinBackoff = time.Second
+const DefaultOutboxMaxBackoff = 5 * time.Minute
+
+var ErrDispatcherRunning = errors.New("outbox dispatcher is already running")
+
+// Publisher publishes outbox events to other systems
+type Publisher interface {
+	Publish(ctx context.Context, event core.Event) error
+}
+
+// PublisherFunc adapts a function to the Publisher interface
+type PublisherFunc func(ctx context.Context, event core.Event) error
+
+func (f PublisherFunc) Publish(ctx context.Context, event core.Event) error {
+	return f(ctx, event)
+}
+
+func NewOutbox(env db.Env) *Outbox {
+	return &Outbox{
+		CollectionBase: db.CollectionBase{Name: OutboxColName, Env: env},
+	}
+}
+
+// Outbox stores an entry per saved event in the same transaction as the event,
+// so publishing can not diverge from the event store.
+type Outbox struct {
+	db.CollectionBase
+	// Codec compresses the payload of the entries, by default the Codec of the Store
+	Codec Codec
+	// Keys encrypts the Data of the entries, by default the Keys of the Store
+	Keys *Keys
+	// Upcasters transform the Data of old entries, by default the Upcasters of the Store
+	Upcasters *Upcasters
+}
+
+func (o *Outbox) Load() (err error) {
+	if o.Collection != nil && !o.IsRecreateDb() {
+		return
+	}
+
+	dao := o.App()
+	if o.Collection, err = dao.FindCollectionByNameOrId(o.Name); o.Collection == nil || o.IsRecreateDb() {
+		if o.Collection != nil {
+			if err = dao.Delete(o.Collection); err != nil {
+				return
+			}
+		}
+
+		o.Collection = pbcore.NewBaseCollection(o.Name)
+		o.Collection.Fields.Add(
+			&pbcore.TextField{
+				Name:     OutboxFieldAggType,
+				Required: true,
+			},
+			&pbcore.TextField{
+				Name:     AggTypeFieldAggId,
+				Required: true,
+			},
+			&pbcore.NumberField{
+				Name:     AggTypeFieldVersion,
+				Required: true,
+			},
+			&pbcore.NumberField{
+				Name:     AggTypeFieldGlobalVersion,
+				Required: true,
+			},
+			&pbcore.TextField{
+				Name:     AggTypeFieldReason,
+				Required: true,
+			},
+			&pbcore.DateField{
+				Name:     AggTypeFieldTimestamp,
+				Required: true,
+			},
+			&pbcore.JSONField{
+				Name:    AggTypeFieldData,
+				MaxSize: PayloadMaxSize,
+			},
+			&pbcore.JSONField{
+				Name:    AggTypeFieldMetadata,
+				MaxSize: PayloadMaxSize,
+			},
+			&pbcore.BoolField{
+				Name: OutboxFieldDelivered,
+			},
+			&pbcore.DateField{
+				Name: OutboxFieldDeliveredAt,
+			},
+			&pbcore.NumberField{
+				Name: OutboxFieldAttempts,
+			},
+			&pbcore.DateField{
+				Name: OutboxFieldNextAttempt,
+			},
+			&pbcore.TextField{
+				Name: OutboxFieldLastError,
+			},
+		)
+
+		indexName := fmt.Sprintf("idx_%v_%v_%v", o.Name, OutboxFieldDelivered, AggTypeFieldGlobalVersion)
+		o.Collection.AddIndex(indexName, false,
+			fmt.Sprintf("%v, %v", OutboxFieldDelivered, AggTypeFieldGlobalVersion), "")
+
+		err = dao.Save(o.Collection)
+	}
+	return
+}
+
+// AddTx adds an outbox entry for the event within the transaction of the event
+func (o *Outbox) AddTx(txApp pbcore.App, event *core.Event) (err error) {
+	record := pbcore.NewRecord(o.Collection)
+	record.Set(OutboxFieldAggType, event.AggregateType)
+	record.Set(AggTypeFieldAggId, event.AggregateID)
+	record.Set(AggTypeFieldVersion, uint64(event.Version))
+	record.Set(AggTypeFieldGlobalVersion, uint64(event.GlobalVersion))
+	record.Set(AggTypeFieldReason, event.Reason)
+	record.Set(AggTypeFieldTimestamp, event.Timestamp)
+	if err = setPayload(record, event, o.Codec); err != nil {
+		return
+	}
+	if o.Keys != nil {
+		if err = o.Keys.encryptRecordTx(txApp, record, event); err != nil {
+			return
+		}
+	}
+	record.Set(OutboxFieldNextAttempt, time.Now())
+
+	err = txApp.Save(record)
+	return
+}
+
+// FindPending returns the undelivered entries due for an attempt in global_version order.
+// The entries of a stream after an entry waiting for its next attempt are not due,
+// so a failing stream does not block the batches of other streams.
+func (o *Outbox) FindPending(ctx context.Context, limit int) (ret []*pbcore.Record, err error) {
+	due := dbx.NewExp(fmt.Sprintf("[[%[1]v.%[2]v]] <= {:now} AND NOT EXISTS (SELECT 1 FROM {{%[1]v}} [[waiting]] "+
+		"WHERE [[waiting.%[3]v]] = FALSE AND [[waiting.%[2]v]] > {:now} "+
+		"AND [[waiting.%[4]v]] = [[%[1]v.%[4]v]] AND [[waiting.%[5]v]] = [[%[1]v.%[5]v]] "+
+		"AND [[waiting.%[6]v]] < [[%[1]v.%[6]v]])",
+		o.Name, OutboxFieldNextAttempt, OutboxFieldDelivered, OutboxFieldAggType, AggTypeFieldAggId,
+		AggTypeFieldGlobalVersion), dbx.Params{"now": types.NowDateTime().String()})
+
+	err = o.App().RecordQuery(o.Collection).
+		WithContext(ctx).
+		AndWhere(dbx.HashExp{OutboxFieldDelivered: false}).
+		AndWhere(due).
+		OrderBy(AggTypeFieldGlobalVersion + " ASC").
+		Limit(int64(limit)).
+		All(&ret)
+	return
+}
+
+func (o *Outbox) MarkDelivered(record *pbcore.Record) (err error) {
+	record.Set(OutboxFieldDelivered, true)
+	record.Set(OutboxFieldDeliveredAt, time.Now())
+	record.Set(OutboxFieldLastError, "")
+	err = o.App().Save(record)
+	return
+}
+
+func (o *Outbox) MarkFailed(record *pbcore.Record, nextAttempt time.Time, cause error) (err error) {
+	record.Set(OutboxFieldAttempts, record.GetInt(OutboxFieldAttempts)+1)
+	record.Set(OutboxFieldNextAttempt, nextAttempt)
+	record.Set(OutboxFieldLastError, cause.Error())
+	err = o.App().Save(record)
+	return
+}
+
+func NewOutboxEvent(record *pbcore.Record) (ret *core.Event, err error) {
+	ret, err = NewEvent(record, record.GetString(OutboxFieldAggType))
+	return
+}
+
+func (o *Outbox) newEvent(record *pbcore.Record) (ret *core.Event, err error) {
+	if ret, err = NewOutboxEvent(record); err != nil {
+		return
+	}
+	err = openEvent(ret, o.Keys, o.Upcasters)
+	return
+}
+
+func NewDispatcher(outbox *Outbox, publisher Publisher) *Dispatcher {
+	return &Dispatcher{
+		Outbox:       outbox,
+		Publisher:    publisher,
+		BatchSize:    DefaultOutboxBatchSize,
+		PollInterval: DefaultOutboxPollInterval,
+		MinBackoff:   DefaultOutboxMinBackoff,
+		MaxBackoff:   DefaultOutboxMaxBackoff,
+	}
+}
+
+// Dispatcher polls the outbox and publishes the pending entries.
+// Failed entries are retried with exponential backoff between MinBackoff and MaxBackoff,
+// later entries of the same aggregate wait until the failed one is delivered.
+type Dispatcher struct {
+	Outbox       *Outbox
+	Publisher    Publisher
+	BatchSize    int
+	PollInterval time.Duration
+	MinBackoff   time.Duration
+	MaxBackoff   time.Duration
+
+	mu      sync.Mutex
+	cancel  context.CancelFunc
+	done    chan struct{}
+	lastErr error
+}
+
+// DispatchOnce publishes one batch of pending entries
+func (d *Dispatcher) DispatchOnce(ctx context.Context) (delivered int, err error) {
+	var records []*pbcore.Record
+	if records, err = d.Outbox.FindPending(ctx, d.BatchSize); err != nil {
+		return
+	}
+
+	blocked := map[string]bool{}
+	for _, record := range records {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+
+		streamKey := record.GetString(OutboxFieldAggType) + "/" + record.GetString(AggTypeFieldAggId)
+		if blocked[streamKey] {
+			continue
+		}
+
+		// an entry, which can not be read or published, is retried later and blocks its stream until then
+		event, publishErr := d.Outbox.newEvent(record)
+		if publishErr == nil {
+			publishErr = d.Publisher.Publish(ctx, *event)
+		}
+		if publishErr != nil {
+			blocked[streamKey] = true
+			nextAttempt := time.Now().Add(d.backoff(record.GetInt(OutboxFieldAttempts) + 1))
+			if err = d.Outbox.MarkFailed(record, nextAttempt, publishErr); err != nil {
+				return
+			}
+			continue
+		}
+
+		if err = d.Outbox.MarkDelivered(record); err != nil {
+			return
+		}
+		delivered++
+	}
+	return
+}
+
+// Start dispatches in the background until Stop or ctx is done
+func (d *Dispatcher) Start(ctx context.Context) (err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.done != nil {
+		err = ErrDispatcherRunning
+		return
+	}
+
+	ctx, d.cancel = context.WithCancel(ctx)
+	d.done = make(chan struct{})
+	d.lastErr = nil
+
+	go d.run(ctx, d.done)
+	return
+}
+
+// Stop stops the background dispatching and waits for it to finish
+func (d *Dispatcher) Stop() {
+	d.mu.Lock()
+	cancel, done := d.cancel, d.done
+	d.mu.Unlock()
+
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+// Err returns the error, which stopped the background dispatching
+func (d *Dispatcher) Err() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.lastErr
+}
+
+func (d *Dispatcher) run(ctx context.Context, done chan struct{}) {
+	var err error
+	defer func() {
+		d.mu.Lock()
+		if !errors.Is(err, context.Canceled) {
+			d.lastErr = err
+		}
+		d.cancel = nil
+		d.done = nil
+		d.mu.Unlock()
+		close(done)
+	}()
+
+	ticker := time.NewTicker(d.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		var delivered int
+		if delivered, err = d.DispatchOnce(ctx); err != nil {
+			return
+		}
+
+		// continue immediately while there is a backlog
+		if delivered >= d.BatchSize {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *Dispatcher) backoff(attempts int) (ret time.Duration) {
+	ret = d.MinBackoff
+	for i := 1; i < attempts && ret < d.MaxBackoff; i++ {
+		ret *= 2
+	}
+	if ret > d.MaxBackoff {
+		ret = d.MaxBackoff
+	}
+	return
+}
@@ -0,0 +1,85 @@
+package eventstore
+
+import (
+	"maps"
+	"slices"
+	"sync"
+
+	"github.com/hallgren/eventsourcing/core"
+
+	pbcore "github.com/pocketbase/pocketbase/core"
+)
+
+// SavedHandler is called with the events of one aggregate after they are committed
+type SavedHandler func(events []core.Event)
+
+// OnSaved calls the handler after the events of an aggregate are committed by Save or SaveMulti,
+// also with the fast path. Replays of already stored events are not reported.
+// The handler runs synchronously in the saving goroutine, the returned function removes it.
+func (store *Store) OnSaved(handler SavedHandler) (unsubscribe func()) {
+	return store.saved.add(handler)
+}
+
+type savedHandlers struct {
+	mu       sync.RWMutex
+	nextId   int
+	handlers map[int]SavedHandler
+}
+
+func (o *savedHandlers) add(handler SavedHandler) (unsubscribe func()) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.handlers == nil {
+		o.handlers = map[int]SavedHandler{}
+	}
+	id := o.nextId
+	o.nextId++
+	o.handlers[id] = handler
+
+	unsubscribe = func() {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		delete(o.handlers, id)
+	}
+	return
+}
+
+// notifyTx calls the handlers with a copy of the events, when the transaction is committed
+func (o *savedHandlers) notifyTx(txApp pbcore.App, events []*core.Event) {
+	if o == nil {
+		return
+	}
+
+	o.mu.RLock()
+	empty := len(o.handlers) == 0
+	o.mu.RUnlock()
+	if empty {
+		return
+	}
+
+	saved := make([]core.Event, len(events))
+	for i, event := range events {
+		saved[i] = *event
+	}
+
+	notify := func() {
+		o.mu.RLock()
+		handlers := slices.Collect(maps.Values(o.handlers))
+		o.mu.RUnlock()
+		for _, handler := range handlers {
+			handler(saved)
+		}
+	}
+
+	if txInfo := txApp.TxInfo(); txInfo != nil {
+		txInfo.OnComplete(func(txErr error) error {
+			if txErr == nil {
+				notify()
+			}
+			return nil
+		})
+	} else {
+		notify()
+	}
+}
@@ -0,0 +1,193 @@
+package eventstore
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pocketbase/dbx"
+
+	pbcore "github.com/pocketbase/pocketbase/core"
+)
+
+const migrateStoragePageSize = 500
+
+var storageNames = map[Storage]string{
+	StorageCollectionPerType: "per-type",
+	StorageSingleCollection:  "single",
+}
+
+func (s Storage) String() string {
+	if name, ok := storageNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("Storage(%d)", int(s))
+}
+
+// ParseStorage returns the storage layout of the name, "per-type" or "single"
+func ParseStorage(name string) (ret Storage, err error) {
+	for storage, storageName := range storageNames {
+		if storageName == name {
+			ret = storage
+			return
+		}
+	}
+	err = fmt.Errorf("unknown storage %v", name)
+	return
+}
+
+// eventFields are the columns of an event record, which are copied between the storage layouts
+var eventFields = []string{
+	AggTypeFieldAggId, AggTypeFieldVersion, AggTypeFieldGlobalVersion, AggTypeFieldReason,
+	AggTypeFieldTimestamp, AggTypeFieldData, AggTypeFieldMetadata, AggTypeFieldEventId,
+}
+
+// MigrateStorage copies the events and their authorizations of all aggregate types into the storage layout.
+// The records are copied as stored, so versions, global versions, compressed and encrypted payloads are kept.
+// The copy runs in one transaction, the collections of the former layout are kept and can be deleted afterwards.
+// The store must be loaded again with the new Storage to use the copied events.
+func (store *Store) MigrateStorage(ctx context.Context, storage Storage) (count int, err error) {
+	if storage == store.Storage {
+		err = fmt.Errorf("the store uses the storage layout already")
+		return
+	}
+
+	var aggTypes map[string]string
+	if aggTypes, err = store.AggregateTypes.FindAll(); err != nil {
+		return
+	}
+
+	// load the collections of both layouts before the transaction
+	type migration struct {
+		source *Aggregate
+		target *Aggregate
+	}
+	var migrations []migration
+	for aggType := range aggTypes {
+		var item migration
+		if item.source, err = store.GetOrCreateForAggType(aggType); err != nil {
+			return
+		}
+		// the target is not cached by the store, it is loaded again with the new Storage
+		item.target = store.newAggregateIn(storage, aggType, store.Env)
+		if err = item.target.Load(); err != nil {
+			return
+		}
+		migrations = append(migrations, item)
+	}
+
+	err = store.App().RunInTransaction(func(txApp pbcore.App) (txErr error) {
+		count = 0
+		for _, item := range migrations {
+			var aggIds map[string]bool
+			var copied int
+			if aggIds, copied, txErr = copyEvents(ctx, txApp, item.source, item.target); txErr != nil {
+				return
+			}
+			count += copied
+
+			if !store.IsAuthDisabled() {
+				if txErr = copyAuth(txApp, item.source, item.target, aggIds); txErr != nil {
+					return
+				}
+			}
+			if txErr = store.AggregateTypes.RegisterTx(txApp, item.source.AggregateType, item.target.Name); txErr != nil {
+				return
+			}
+		}
+		return
+	})
+	return
+}
+
+func copyEvents(ctx context.Context, txApp pbcore.App, source *Aggregate, target *Aggregate) (
+	aggIds map[string]bool, count int, err error) {
+
+	aggIds = map[string]bool{}
+	var lastGlobalVersion int
+	for {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+
+		var records []*pbcore.Record
+		if err = source.RecordQuery(txApp).
+			AndWhere(dbx.NewExp(fmt.Sprintf("%v > {:%v}", AggTypeFieldGlobalVersion, AggTypeFieldGlobalVersion),
+				dbx.Params{AggTypeFieldGlobalVersion: lastGlobalVersion})).
+			OrderBy(AggTypeFieldGlobalVersion + " ASC").
+			Limit(migrateStoragePageSize).
+			All(&records); err != nil || len(records) == 0 {
+			return
+		}
+
+		for _, record := range records {
+			copied := pbcore.NewRecord(target.Collection)
+			for _, field := range eventFields {
+				copied.Set(field, record.Get(field))
+			}
+			if target.Shared {
+				copied.Set(AggTypeFieldAggType, source.AggregateType)
+			}
+
+			if err = txApp.Save(copied); err != nil {
+				if isUniqueViolation(err) {
+					err = fmt.Errorf("the event %v of %v %v exists already: %w",
+						record.GetInt(AggTypeFieldVersion), source.AggregateType, record.GetString(AggTypeFieldAggId), err)
+				}
+				return
+			}
+			aggIds[record.GetString(AggTypeFieldAggId)] = true
+			lastGlobalVersion = record.GetInt(AggTypeFieldGlobalVersion)
+			count++
+		}
+	}
+}
+
+// copyAuth copies the authorizations of the migrated aggregates into the target auth collection.
+// An authorization of the aggregate in the target already fails the migration, it is not merged.
+func copyAuth(txApp pbcore.App, source *Aggregate, target *Aggregate, aggIds map[string]bool) (err error) {
+	fieldKey := source.AuthBuilder.FieldKey
+
+	var where []dbx.Expression
+	if fieldScope := source.AuthBuilder.FieldScope; fieldScope != "" {
+		where = append(where, dbx.HashExp{fieldScope: source.AggregateType})
+	}
+
+	var records []*pbcore.Record
+	if records, err = txApp.FindAllRecords(source.CollectionAuth.Collection, where...); err != nil {
+		return
+	}
+
+	for _, record := range records {
+		aggId := record.GetString(fieldKey)
+		if !aggIds[aggId] {
+			continue
+		}
+
+		key := dbx.HashExp{target.AuthBuilder.FieldKey: aggId}
+		if fieldScope := target.AuthBuilder.FieldScope; fieldScope != "" {
+			key[fieldScope] = source.AggregateType
+		}
+
+		var existing []*pbcore.Record
+		if existing, err = txApp.FindAllRecords(target.CollectionAuth.Collection, key); err != nil {
+			return
+		}
+		if len(existing) > 0 {
+			err = fmt.Errorf("the authorization of %v %v exists already in %v",
+				source.AggregateType, aggId, target.CollectionAuth.Name)
+			return
+		}
+
+		copied := pbcore.NewRecord(target.CollectionAuth.Collection)
+		for field, value := range key {
+			copied.Set(field, value)
+		}
+		for _, role := range source.AuthBuilder.Roles {
+			copied.Set(target.AuthBuilder.AuthFieldFor(role), record.Get(source.AuthBuilder.AuthFieldFor(role)))
+		}
+		if err = txApp.Save(copied); err != nil {
+			return
+		}
+	}
+	return
+}
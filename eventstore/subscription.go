@@ -0,0 +1,123 @@
+package eventstore
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	"github.com/hallgren/eventsourcing/core"
+)
+
+const DefaultSubscriptionBufferSize = 100
+
+// SubscriptionFilter selects the events of a subscription, an empty list matches all values
+type SubscriptionFilter struct {
+	AggregateTypes []string
+	AggregateIDs   []string
+	Reasons        []string
+}
+
+func (f *SubscriptionFilter) Match(event *core.Event) bool {
+	return matchAny(f.AggregateTypes, event.AggregateType) &&
+		matchAny(f.AggregateIDs, event.AggregateID) &&
+		matchAny(f.Reasons, event.Reason)
+}
+
+func matchAny(values []string, value string) bool {
+	return len(values) == 0 || slices.Contains(values, value)
+}
+
+// Subscribe returns a channel with the saved events matching the filter, see SubscribeFunc.
+// Events are delivered only after the saving transaction is committed, in commit order.
+// Save never waits for the consumer: a consumer falling behind by more than DefaultSubscriptionBufferSize events
+// is disconnected by closing the channel, it resumes with All after the last received global version.
+// The channel is closed as well when ctx is done.
+func (store *Store) Subscribe(ctx context.Context, filter SubscriptionFilter) (ret <-chan core.Event, err error) {
+	events := make(chan core.Event, DefaultSubscriptionBufferSize)
+
+	var mu sync.Mutex
+	closed := false
+	closeEvents := func() {
+		if !closed {
+			closed = true
+			close(events)
+		}
+	}
+
+	unsubscribe := store.OnSaved(func(saved []core.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		for i := 0; i < len(saved) && !closed; i++ {
+			if !filter.Match(&saved[i]) {
+				continue
+			}
+			select {
+			case events <- saved[i]:
+			default:
+				store.App().Logger().Warn("subscription: consumer too slow, disconnected",
+					"globalVersion", saved[i].GlobalVersion)
+				closeEvents()
+			}
+		}
+	})
+
+	go func() {
+		<-ctx.Done()
+		unsubscribe()
+
+		mu.Lock()
+		closeEvents()
+		mu.Unlock()
+	}()
+
+	ret = events
+	return
+}
+
+// SubscribeFunc calls the handler for every event matching the filter, saved by Save or SaveMulti of the store.
+// It is called after the transaction is committed, also for the fast path, see OnSaved.
+// The handler runs in a goroutine of the subscription, one event after another, so a slow handler does not block Save.
+// Events exceeding DefaultSubscriptionBufferSize pending events are dropped and logged.
+// The returned function removes the subscription.
+func (store *Store) SubscribeFunc(filter SubscriptionFilter, handler func(event core.Event)) (unsubscribe func(), err error) {
+	queue := make(chan core.Event, DefaultSubscriptionBufferSize)
+
+	var mu sync.Mutex
+	closed := false
+
+	remove := store.OnSaved(func(saved []core.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		if closed {
+			return
+		}
+		for i := range saved {
+			if !filter.Match(&saved[i]) {
+				continue
+			}
+			select {
+			case queue <- saved[i]:
+			default:
+				store.App().Logger().Warn("subscription: handler too slow, event dropped",
+					"aggType", saved[i].AggregateType, "aggId", saved[i].AggregateID,
+					"globalVersion", saved[i].GlobalVersion)
+			}
+		}
+	})
+
+	go func() {
+		for event := range queue {
+			handler(event)
+		}
+	}()
+
+	unsubscribe = sync.OnceFunc(func() {
+		remove()
+
+		mu.Lock()
+		closed = true
+		close(queue)
+		mu.Unlock()
+	})
+	return
+}
@@ -0,0 +1,149 @@
+package eventstore
+
+import (
+	"github.com/hallgren/eventsourcing/core"
+
+	pbcore "github.com/pocketbase/pocketbase/core"
+)
+
+// SaveMulti persists events of several aggregates, also of different aggregate types, in one transaction.
+// The optimistic concurrency is checked for each aggregate and the global versions are allocated once,
+// in the order of the events. Either all events are saved or none.
+func (store *Store) SaveMulti(events []core.Event) (err error) {
+	// If no event return no error
+	if len(events) == 0 {
+		return
+	}
+
+	// load the collections before the transaction
+	if _, err = store.groupByAggregate(events); err != nil {
+		return
+	}
+
+	err = store.App().RunInTransaction(func(txApp pbcore.App) error {
+		return store.SaveMultiTx(txApp, events)
+	})
+	return
+}
+
+// SaveMultiTx is SaveMulti within the given transaction.
+// The collections of the aggregate types must be loaded before, e.g. by GetOrCreateForAggType.
+func (store *Store) SaveMultiTx(txApp pbcore.App, events []core.Event) (err error) {
+	// If no event return no error
+	if len(events) == 0 {
+		return
+	}
+
+	var streams []*aggregateStream
+	if streams, err = store.groupByAggregate(events); err != nil {
+		return
+	}
+
+	pending := map[*core.Event]bool{}
+	defer func() {
+		if err != nil {
+			// the global versions of a rolled back transaction are not valid
+			for event := range pending {
+				event.GlobalVersion = 0
+			}
+		}
+	}()
+
+	err = func() (txErr error) {
+		for _, stream := range streams {
+			if txErr = stream.aggregate.prepareStreamTx(txApp, stream.streamEvents); txErr != nil {
+				return
+			}
+			if !stream.replayed {
+				for _, event := range stream.events {
+					pending[event] = true
+				}
+			}
+		}
+
+		if len(pending) == 0 {
+			return
+		}
+
+		var globalVersions []int
+		if globalVersions, txErr = store.globalVersions().GetNextMultipleTx(txApp, GlobalVersionSequence, len(pending)); txErr != nil {
+			return
+		}
+
+		// allocate in the order of the events in the batch
+		index := 0
+		for i := range events {
+			if pending[&events[i]] {
+				events[i].GlobalVersion = core.Version(globalVersions[index])
+				index++
+			}
+		}
+
+		for _, stream := range streams {
+			if !stream.replayed {
+				if txErr = stream.aggregate.insertTx(txApp, stream.streamEvents); txErr != nil {
+					return
+				}
+			}
+		}
+		return
+	}()
+	return
+}
+
+// aggregateStream are the events of one aggregate within a SaveMulti batch
+type aggregateStream struct {
+	*streamEvents
+	aggregate *Aggregate
+}
+
+func (store *Store) groupByAggregate(events []core.Event) (ret []*aggregateStream, err error) {
+	type streamKey struct {
+		aggType string
+		aggId   string
+	}
+
+	streams := map[streamKey]*aggregateStream{}
+	for i := range events {
+		event := &events[i]
+		key := streamKey{aggType: event.AggregateType, aggId: event.AggregateID}
+		stream := streams[key]
+		if stream == nil {
+			var aggregate *Aggregate
+			if aggregate, err = store.GetOrCreateForAggType(event.AggregateType); err != nil {
+				return
+			}
+			stream = &aggregateStream{streamEvents: &streamEvents{}, aggregate: aggregate}
+			streams[key] = stream
+			ret = append(ret, stream)
+		}
+		stream.events = append(stream.events, event)
+		stream.eventIds = append(stream.eventIds, "")
+	}
+	return
+}
+
+func (store *Store) NewUnitOfWork() *UnitOfWork {
+	return &UnitOfWork{store: store}
+}
+
+// UnitOfWork collects the events of several aggregates and saves them atomically on Commit
+type UnitOfWork struct {
+	store  *Store
+	events []core.Event
+}
+
+func (u *UnitOfWork) Add(events ...core.Event) *UnitOfWork {
+	u.events = append(u.events, events...)
+	return u
+}
+
+// Events returns the collected events, after a successful Commit with their global versions
+func (u *UnitOfWork) Events() []core.Event {
+	return u.events
+}
+
+func (u *UnitOfWork) Commit() (err error) {
+	err = u.store.SaveMulti(u.events)
+	return
+}
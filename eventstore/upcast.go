@@ -0,0 +1,137 @@
+package eventstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/hallgren/eventsourcing/core"
+)
+
+// MetadataKeySchemaVersion is the metadata key of the schema version of the event Data.
+// Events without it have the schema version 1.
+const MetadataKeySchemaVersion = "schema_version"
+
+// Upcaster transforms the Data of an event from one schema version to the next one
+type Upcaster func(data []byte) ([]byte, error)
+
+type upcasterKey struct {
+	aggType string
+	reason  string
+	version int
+}
+
+type reasonKey struct {
+	aggType string
+	reason  string
+}
+
+func NewUpcasters() *Upcasters {
+	return &Upcasters{
+		upcasters: map[upcasterKey]Upcaster{},
+		current:   map[reasonKey]int{},
+	}
+}
+
+// Upcasters transforms old event Data on read into the current shape.
+// The current schema version of an event is the one after the latest registered upcaster,
+// it is stored in the metadata of new events.
+type Upcasters struct {
+	mu        sync.RWMutex
+	upcasters map[upcasterKey]Upcaster
+	current   map[reasonKey]int
+}
+
+// Register adds the upcaster from the schema version fromVersion to fromVersion+1
+func (o *Upcasters) Register(aggType string, reason string, fromVersion int, upcaster Upcaster) *Upcasters {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.upcasters[upcasterKey{aggType: aggType, reason: reason, version: fromVersion}] = upcaster
+	key := reasonKey{aggType: aggType, reason: reason}
+	if o.current[key] < fromVersion+1 {
+		o.current[key] = fromVersion + 1
+	}
+	return o
+}
+
+// CurrentVersion returns the schema version of new events
+func (o *Upcasters) CurrentVersion(aggType string, reason string) (ret int) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	if ret = o.current[reasonKey{aggType: aggType, reason: reason}]; ret == 0 {
+		ret = 1
+	}
+	return
+}
+
+// Upcast transforms the Data of the event to the current schema version and updates the version in the metadata
+func (o *Upcasters) Upcast(event *core.Event) (err error) {
+	var metadata map[string]any
+	var version int
+	if metadata, version, err = schemaVersionOf(event); err != nil {
+		return
+	}
+
+	current := o.CurrentVersion(event.AggregateType, event.Reason)
+	if version >= current {
+		return
+	}
+
+	data := event.Data
+	for ; version < current; version++ {
+		o.mu.RLock()
+		upcaster := o.upcasters[upcasterKey{aggType: event.AggregateType, reason: event.Reason, version: version}]
+		o.mu.RUnlock()
+
+		if upcaster == nil {
+			err = fmt.Errorf("no upcaster of %v %v from schema version %d", event.AggregateType, event.Reason, version)
+			return
+		}
+		if data, err = upcaster(data); err != nil {
+			err = fmt.Errorf("upcast %v %v from schema version %d: %w", event.AggregateType, event.Reason, version, err)
+			return
+		}
+	}
+
+	metadata[MetadataKeySchemaVersion] = version
+	if event.Metadata, err = json.Marshal(metadata); err != nil {
+		return
+	}
+	event.Data = data
+	return
+}
+
+// stamp sets the current schema version in the metadata of a new event, if not set by the caller
+func (o *Upcasters) stamp(event *core.Event) (err error) {
+	var metadata map[string]any
+	if metadata, _, err = schemaVersionOf(event); err != nil {
+		return
+	}
+	if _, ok := metadata[MetadataKeySchemaVersion]; ok {
+		return
+	}
+
+	metadata[MetadataKeySchemaVersion] = o.CurrentVersion(event.AggregateType, event.Reason)
+	event.Metadata, err = json.Marshal(metadata)
+	return
+}
+
+func schemaVersionOf(event *core.Event) (metadata map[string]any, version int, err error) {
+	version = 1
+	if len(event.Metadata) > 0 && string(event.Metadata) != "null" {
+		if err = json.Unmarshal(event.Metadata, &metadata); err != nil {
+			err = fmt.Errorf("metadata of %v %v: %w", event.AggregateType, event.AggregateID, err)
+			return
+		}
+	}
+	if metadata == nil {
+		metadata = map[string]any{}
+	}
+
+	if value, ok := metadata[MetadataKeySchemaVersion].(float64); ok && value > 0 {
+		version = int(value)
+	}
+	return
+}
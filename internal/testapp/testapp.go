@@ -0,0 +1,75 @@
+// Package testapp bootstraps the PocketBase apps of the tests in temporary data directories
+package testapp
+
+import (
+	"log"
+	"testing"
+
+	"github.com/go-ee/eventsoutcing_pocketbase/db"
+	"github.com/pocketbase/pocketbase"
+
+	pbcore "github.com/pocketbase/pocketbase/core"
+)
+
+// AuthRoles are the roles of the aggregate authorizations in the tests
+var AuthRoles = []string{"admin", "maintainer", "user"}
+
+// New bootstraps a PocketBase app in a temporary data directory of the test and loads the users
+func New(t testing.TB) (appInst *Env, user *db.User) {
+	t.Helper()
+	appInst = &Env{
+		PocketBase: pocketbase.NewWithConfig(pocketbase.Config{DefaultDataDir: t.TempDir()}),
+	}
+
+	if err := appInst.Bootstrap(); err != nil {
+		t.Fatalf("Failed to bootstrap PocketBase app: %v", err)
+	}
+
+	log.Printf("Pocketbase data dir: %v\n", appInst.DataDir())
+
+	user = db.NewUser(appInst)
+	if err := user.Load(); err != nil {
+		t.Fatalf("Failed to load user: %v", err)
+	}
+	return
+}
+
+// Env is the db.Env of the tests
+type Env struct {
+	*pocketbase.PocketBase
+
+	Recreate     bool
+	RecreateAuth bool
+	AuthDisabled bool
+}
+
+func (o *Env) App() pbcore.App {
+	return o.PocketBase
+}
+
+func (o *Env) IsRecreateDb() bool {
+	return o.Recreate
+}
+
+func (o *Env) IsRecreateDbAuth() bool {
+	return o.RecreateAuth
+}
+
+func (o *Env) IsAuthDisabled() bool {
+	return o.AuthDisabled
+}
+
+// WithMasterKey returns the env supplying the master key of the encryption
+func (o *Env) WithMasterKey(masterKey []byte) *MasterKeyEnv {
+	return &MasterKeyEnv{Env: o, masterKey: masterKey}
+}
+
+// MasterKeyEnv is the db.MasterKeyEnv of the tests
+type MasterKeyEnv struct {
+	*Env
+	masterKey []byte
+}
+
+func (o *MasterKeyEnv) MasterKey() []byte {
+	return o.masterKey
+}
@@ -0,0 +1,281 @@
+package projection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-ee/eventsoutcing_pocketbase/db"
+	"github.com/go-ee/eventsoutcing_pocketbase/eventstore"
+	"github.com/hallgren/eventsourcing/core"
+)
+
+const DefaultBatchSize = 100
+const DefaultPollInterval = time.Second
+const DefaultMaxRetries = 3
+const DefaultRetryDelay = time.Second
+
+// ErrorPolicy decides what happens when a handler fails
+type ErrorPolicy int
+
+const (
+	// ErrorPolicyStop stops the projection at the failing event, the checkpoint stays before it
+	ErrorPolicyStop ErrorPolicy = iota
+	// ErrorPolicySkip logs the failure and continues with the next event
+	ErrorPolicySkip
+	// ErrorPolicyRetry retries the handler MaxRetries times with RetryDelay and stops if it still fails
+	ErrorPolicyRetry
+)
+
+var ErrRunning = errors.New("projection is already running")
+
+// Handler handles one event of the global event stream
+type Handler func(ctx context.Context, event core.Event) error
+
+func New(name string, store *eventstore.Store, checkpoints *db.Checkpoints) *Projection {
+	return &Projection{
+		Name:         name,
+		Store:        store,
+		Checkpoints:  checkpoints,
+		BatchSize:    DefaultBatchSize,
+		PollInterval: DefaultPollInterval,
+		ErrorPolicy:  ErrorPolicyStop,
+		MaxRetries:   DefaultMaxRetries,
+		RetryDelay:   DefaultRetryDelay,
+
+		handlers: map[handlerKey][]Handler{},
+	}
+}
+
+// Projection consumes the events of all aggregate types in global_version order
+// and persists the last handled global version as checkpoint under its name.
+// Events are delivered at least once, a restart continues after the last persisted checkpoint.
+type Projection struct {
+	Name         string
+	Store        *eventstore.Store
+	Checkpoints  *db.Checkpoints
+	BatchSize    uint64
+	PollInterval time.Duration
+	ErrorPolicy  ErrorPolicy
+	MaxRetries   int
+	RetryDelay   time.Duration
+
+	handlers map[handlerKey][]Handler
+
+	mu      sync.Mutex
+	cancel  context.CancelFunc
+	done    chan struct{}
+	lastErr error
+}
+
+type handlerKey struct {
+	aggType string
+	reason  string
+}
+
+// On registers a handler for the aggregate type and reason, an empty value matches all
+func (p *Projection) On(aggType string, reason string, handler Handler) *Projection {
+	key := handlerKey{aggType: aggType, reason: reason}
+	p.handlers[key] = append(p.handlers[key], handler)
+	return p
+}
+
+// Checkpoint returns the persisted global version the projection has handled
+func (p *Projection) Checkpoint() (ret core.Version, err error) {
+	var version int
+	if version, err = p.Checkpoints.Get(p.Name); err != nil {
+		return
+	}
+	ret = core.Version(version)
+	return
+}
+
+// RunOnce handles all events after the checkpoint until the projection has caught up
+func (p *Projection) RunOnce(ctx context.Context) (count int, err error) {
+	var checkpoint core.Version
+	if checkpoint, err = p.Checkpoint(); err != nil {
+		return
+	}
+
+	fetch := p.Store.All(ctx, checkpoint, p.BatchSize)
+	for {
+		var handled int
+		handled, checkpoint, err = p.runBatch(ctx, fetch, checkpoint)
+		count += handled
+		if err != nil || handled == 0 {
+			return
+		}
+	}
+}
+
+// Start runs the projection in the background, polling for new events until Stop or ctx is done
+func (p *Projection) Start(ctx context.Context) (err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.done != nil {
+		err = ErrRunning
+		return
+	}
+
+	ctx, p.cancel = context.WithCancel(ctx)
+	p.done = make(chan struct{})
+	p.lastErr = nil
+
+	go p.run(ctx, p.done)
+	return
+}
+
+// Stop stops the background run and waits for it to finish
+func (p *Projection) Stop() {
+	p.mu.Lock()
+	cancel, done := p.cancel, p.done
+	p.mu.Unlock()
+
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+// Err returns the error, which stopped the background run
+func (p *Projection) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lastErr
+}
+
+// Rebuild resets the checkpoint to zero and handles all events again.
+// The projection must be stopped and its read model cleared by the caller before.
+func (p *Projection) Rebuild(ctx context.Context) (count int, err error) {
+	p.mu.Lock()
+	running := p.done != nil
+	p.mu.Unlock()
+
+	if running {
+		err = ErrRunning
+		return
+	}
+
+	if err = p.Checkpoints.Set(p.Name, 0); err != nil {
+		return
+	}
+	count, err = p.RunOnce(ctx)
+	return
+}
+
+func (p *Projection) run(ctx context.Context, done chan struct{}) {
+	var err error
+	defer func() {
+		p.mu.Lock()
+		if !errors.Is(err, context.Canceled) {
+			p.lastErr = err
+		}
+		p.cancel = nil
+		p.done = nil
+		p.mu.Unlock()
+		close(done)
+	}()
+
+	ticker := time.NewTicker(p.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		if _, err = p.RunOnce(ctx); err != nil {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Projection) runBatch(ctx context.Context, fetch eventstore.Fetcher, checkpoint core.Version) (
+	handled int, lastVersion core.Version, err error) {
+
+	lastVersion = checkpoint
+
+	var iterator core.Iterator
+	if iterator, err = fetch(); err != nil {
+		return
+	}
+	defer iterator.Close()
+
+	for iterator.Next() {
+		var event core.Event
+		if event, err = iterator.Value(); err != nil {
+			break
+		}
+
+		if err = p.handle(ctx, event); err != nil {
+			break
+		}
+		handled++
+		lastVersion = event.GlobalVersion
+	}
+
+	if lastVersion != checkpoint {
+		if saveErr := p.Checkpoints.Set(p.Name, int(lastVersion)); saveErr != nil && err == nil {
+			err = saveErr
+		}
+	}
+	return
+}
+
+func (p *Projection) handle(ctx context.Context, event core.Event) (err error) {
+	for _, handler := range p.handlersFor(event) {
+		if err = p.callHandler(ctx, handler, event); err != nil {
+			if p.ErrorPolicy != ErrorPolicySkip {
+				err = fmt.Errorf("projection %v, event %v/%v version %v: %w",
+					p.Name, event.AggregateType, event.AggregateID, event.Version, err)
+				return
+			}
+
+			p.Store.App().Logger().Warn("projection skips failed event",
+				"projection", p.Name, "aggType", event.AggregateType, "aggId", event.AggregateID,
+				"version", event.Version, "error", err)
+			err = nil
+		}
+	}
+	return
+}
+
+func (p *Projection) callHandler(ctx context.Context, handler Handler, event core.Event) (err error) {
+	if err = handler(ctx, event); err == nil || p.ErrorPolicy != ErrorPolicyRetry {
+		return
+	}
+
+	for attempt := 0; attempt < p.MaxRetries; attempt++ {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		case <-time.After(p.RetryDelay):
+		}
+
+		if err = handler(ctx, event); err == nil {
+			return
+		}
+	}
+	return
+}
+
+func (p *Projection) handlersFor(event core.Event) (ret []Handler) {
+	keys := []handlerKey{
+		{aggType: event.AggregateType, reason: event.Reason},
+		{aggType: event.AggregateType},
+		{reason: event.Reason},
+		{},
+	}
+	for _, key := range keys {
+		ret = append(ret, p.handlers[key]...)
+	}
+	return
+}
@@ -0,0 +1,171 @@
+package projection
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-ee/eventsoutcing_pocketbase/db"
+	"github.com/go-ee/eventsoutcing_pocketbase/eventstore"
+	"github.com/go-ee/eventsoutcing_pocketbase/internal/testapp"
+	"github.com/hallgren/eventsourcing/core"
+)
+
+func TestProjection(t *testing.T) {
+	store, checkpoints := newTestStore(t)
+
+	for i, aggType := range []string{"Person", "Order", "Person"} {
+		saveTestEvent(t, store, aggType, string(rune('a'+i)))
+	}
+
+	var persons, all int
+	p := New("counter", store, checkpoints).
+		On("Person", "Created", func(_ context.Context, _ core.Event) error {
+			persons++
+			return nil
+		}).
+		On("", "", func(_ context.Context, _ core.Event) error {
+			all++
+			return nil
+		})
+
+	count, err := p.RunOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 || persons != 2 || all != 3 {
+		t.Fatalf("expected 3 events with 2 persons, got %d events, %d persons, %d all", count, persons, all)
+	}
+
+	checkpoint, err := p.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkpoint != 3 {
+		t.Fatalf("expected checkpoint 3, got %d", checkpoint)
+	}
+
+	// a second run continues after the checkpoint
+	saveTestEvent(t, store, "Order", "d")
+	if count, err = p.RunOnce(context.Background()); err != nil || count != 1 {
+		t.Fatalf("expected 1 new event, got %d, %v", count, err)
+	}
+
+	persons, all = 0, 0
+	if count, err = p.Rebuild(context.Background()); err != nil || count != 4 {
+		t.Fatalf("expected rebuild over 4 events, got %d, %v", count, err)
+	}
+	if persons != 2 || all != 4 {
+		t.Fatalf("unexpected rebuild result: %d persons, %d all", persons, all)
+	}
+}
+
+func TestProjectionErrorPolicies(t *testing.T) {
+	store, checkpoints := newTestStore(t)
+
+	for _, aggId := range []string{"a", "b", "c"} {
+		saveTestEvent(t, store, "Person", aggId)
+	}
+
+	failB := func(_ context.Context, event core.Event) error {
+		if event.AggregateID == "b" {
+			return errors.New("failed")
+		}
+		return nil
+	}
+
+	stop := New("stop", store, checkpoints).On("Person", "", failB)
+	if _, err := stop.RunOnce(context.Background()); err == nil {
+		t.Fatal("expected error with stop policy")
+	}
+	if checkpoint, _ := stop.Checkpoint(); checkpoint != 1 {
+		t.Fatalf("expected checkpoint before failed event, got %d", checkpoint)
+	}
+
+	skip := New("skip", store, checkpoints).On("Person", "", failB)
+	skip.ErrorPolicy = ErrorPolicySkip
+	if count, err := skip.RunOnce(context.Background()); err != nil || count != 3 {
+		t.Fatalf("expected all events handled with skip policy, got %d, %v", count, err)
+	}
+
+	var attempts int
+	retry := New("retry", store, checkpoints).On("Person", "", func(_ context.Context, event core.Event) error {
+		if event.AggregateID == "b" {
+			if attempts++; attempts < 2 {
+				return errors.New("failed")
+			}
+		}
+		return nil
+	})
+	retry.ErrorPolicy = ErrorPolicyRetry
+	retry.RetryDelay = time.Millisecond
+	if count, err := retry.RunOnce(context.Background()); err != nil || count != 3 {
+		t.Fatalf("expected all events handled with retry policy, got %d, %v", count, err)
+	}
+}
+
+func TestProjectionStartStop(t *testing.T) {
+	store, checkpoints := newTestStore(t)
+
+	handled := make(chan core.Event, 1)
+	p := New("live", store, checkpoints).On("", "", func(_ context.Context, event core.Event) error {
+		handled <- event
+		return nil
+	})
+	p.PollInterval = 10 * time.Millisecond
+
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Start(context.Background()); !errors.Is(err, ErrRunning) {
+		t.Fatalf("expected ErrRunning, got %v", err)
+	}
+
+	saveTestEvent(t, store, "Person", "a")
+
+	select {
+	case event := <-handled:
+		if event.AggregateID != "a" {
+			t.Fatalf("unexpected event %v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event was not handled")
+	}
+
+	p.Stop()
+	if err := p.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func saveTestEvent(t *testing.T, store *eventstore.Store, aggType string, aggId string) {
+	t.Helper()
+	err := store.Save([]core.Event{{
+		AggregateID:   aggId,
+		AggregateType: aggType,
+		Version:       1,
+		Timestamp:     time.Now(),
+		Reason:        "Created",
+		Data:          []byte(`{"name":"test"}`),
+		Metadata:      []byte(`{"test":"hello"}`),
+	}})
+	if err != nil {
+		t.Fatalf("Failed to save event: %v", err)
+	}
+}
+
+func newTestStore(t *testing.T) (store *eventstore.Store, checkpoints *db.Checkpoints) {
+	t.Helper()
+	appInst, user := testapp.New(t)
+	store = eventstore.New(user, testapp.AuthRoles, appInst)
+	if err := store.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	checkpoints = db.NewCheckpoints(appInst)
+	if err := checkpoints.Load(); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
@@ -0,0 +1,65 @@
+package snapshotstore
+
+import (
+	"context"
+	"errors"
+
+	"github.com/go-ee/eventsoutcing_pocketbase/db"
+	"github.com/go-ee/eventsoutcing_pocketbase/eventstore"
+	"github.com/hallgren/eventsourcing/core"
+	"github.com/pocketbase/dbx"
+)
+
+// Loaded is the latest snapshot of an aggregate with the events stored after it
+type Loaded struct {
+	// Snapshot is nil, if the aggregate has no snapshot of the current schema version
+	Snapshot *core.Snapshot
+	// Events are the events after the version of the snapshot, all events without a snapshot
+	Events []core.Event
+}
+
+// Version returns the version of the aggregate after applying the events to the snapshot, 0 if it has none
+func (o *Loaded) Version() (ret core.Version) {
+	if len(o.Events) > 0 {
+		ret = o.Events[len(o.Events)-1].Version
+	} else if o.Snapshot != nil {
+		ret = o.Snapshot.Version
+	}
+	return
+}
+
+// Load reads the latest snapshot of the aggregate and the events after its version in one read transaction,
+// so an append between both reads can not lead to an inconsistent view.
+func (o *StoreCollections) Load(ctx context.Context, aggType string, aggId string) (ret *Loaded, err error) {
+	// load the collections before the transaction
+	var snapCol *SnapCol
+	if snapCol, err = o.GetOrCreateForAggType(aggType); err != nil {
+		return
+	}
+	var aggregate *eventstore.Aggregate
+	if aggregate, err = o.EventStore.GetOrCreateForAggType(aggType); err != nil {
+		return
+	}
+
+	err = db.RunInReadTransaction(ctx, o.EventStore.App(), func(tx dbx.Builder) (txErr error) {
+		loaded := &Loaded{}
+
+		var snapshot core.Snapshot
+		if snapshot, txErr = snapCol.GetTx(ctx, tx, aggId, aggType); txErr == nil {
+			loaded.Snapshot = &snapshot
+		} else if !errors.Is(txErr, core.ErrSnapshotNotFound) {
+			return
+		}
+
+		var afterVersion core.Version
+		if loaded.Snapshot != nil {
+			afterVersion = loaded.Snapshot.Version
+		}
+		if loaded.Events, txErr = aggregate.FindAfterVersionTx(ctx, tx, aggId, afterVersion); txErr != nil {
+			return
+		}
+		ret = loaded
+		return
+	})
+	return
+}
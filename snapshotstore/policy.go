@@ -0,0 +1,188 @@
+package snapshotstore
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hallgren/eventsourcing/core"
+)
+
+const DefaultAutoSnapshotQueueSize = 1000
+
+// Snapshotter returns the current state of an aggregate as a snapshot, e.g. by loading the aggregate
+// with its repository. The Version of the snapshot must be the version of the loaded aggregate.
+type Snapshotter func(ctx context.Context, aggType string, aggId string) (core.Snapshot, error)
+
+// Policy decides when a snapshot of an aggregate is due, a zero value disables the criterion
+type Policy struct {
+	// Every takes a snapshot, when a save reaches a multiple of Every events of the aggregate
+	Every core.Version
+	// Threshold takes a snapshot, when more events are stored after the last snapshot
+	Threshold core.Version
+	// MaxAge takes a snapshot, when the last snapshot is older
+	MaxAge time.Duration
+}
+
+// Due returns true, if a snapshot is due after the versions fromVersion to toVersion of the aggregate were saved.
+// The last snapshot is nil, if the aggregate has none.
+func (o *Policy) Due(last *SnapshotInfo, fromVersion core.Version, toVersion core.Version, now time.Time) bool {
+	if o.Every > 0 && toVersion/o.Every > (fromVersion-1)/o.Every {
+		return true
+	}
+
+	var lastVersion core.Version
+	if last != nil {
+		lastVersion = last.Version
+	}
+	if o.Threshold > 0 && toVersion > lastVersion+o.Threshold {
+		return true
+	}
+	return o.MaxAge > 0 && last != nil && last.Version < toVersion && now.Sub(last.TakenAt) > o.MaxAge
+}
+
+func NewAutoSnapshots(store *StoreCollections, policy Policy, snapshotter Snapshotter) *AutoSnapshots {
+	return &AutoSnapshots{
+		Store:       store,
+		Policy:      policy,
+		Snapshotter: snapshotter,
+		QueueSize:   DefaultAutoSnapshotQueueSize,
+	}
+}
+
+// AutoSnapshots takes the snapshots due by the policy after the events of an aggregate are saved.
+// The policy is evaluated and the snapshots are taken in a background goroutine, so Save is not blocked.
+// Saves arriving while the queue is full are not considered for a snapshot.
+type AutoSnapshots struct {
+	Store       *StoreCollections
+	Policy      Policy
+	Snapshotter Snapshotter
+	QueueSize   int
+
+	mu          sync.Mutex
+	queue       chan *snapshotRequest
+	pending     map[snapshotKey]*snapshotRequest
+	unsubscribe func()
+	cancel      context.CancelFunc
+	done        chan struct{}
+}
+
+type snapshotKey struct {
+	aggType string
+	aggId   string
+}
+
+type snapshotRequest struct {
+	snapshotKey
+	fromVersion core.Version
+	toVersion   core.Version
+}
+
+// Start evaluates the policy for the saved events until Stop
+func (o *AutoSnapshots) Start() (err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.queue != nil {
+		err = fmt.Errorf("auto snapshots already started")
+		return
+	}
+
+	var ctx context.Context
+	ctx, o.cancel = context.WithCancel(context.Background())
+	o.queue = make(chan *snapshotRequest, o.QueueSize)
+	o.pending = map[snapshotKey]*snapshotRequest{}
+	o.done = make(chan struct{})
+	o.unsubscribe = o.Store.EventStore.OnSaved(o.saved)
+
+	go o.run(ctx, o.queue, o.done)
+	return
+}
+
+// Stop takes the snapshots of the already queued requests and stops the background goroutine
+func (o *AutoSnapshots) Stop() {
+	o.mu.Lock()
+	if o.queue == nil {
+		o.mu.Unlock()
+		return
+	}
+	o.unsubscribe()
+	close(o.queue)
+	o.queue = nil
+	done, cancel := o.done, o.cancel
+	o.mu.Unlock()
+
+	<-done
+	cancel()
+}
+
+// saved queues the saved aggregate without waiting, an aggregate already queued is extended
+func (o *AutoSnapshots) saved(events []core.Event) {
+	if len(events) == 0 {
+		return
+	}
+
+	first, last := &events[0], &events[len(events)-1]
+	key := snapshotKey{aggType: first.AggregateType, aggId: first.AggregateID}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.queue == nil {
+		return
+	}
+
+	if request := o.pending[key]; request != nil {
+		request.toVersion = max(request.toVersion, last.Version)
+		return
+	}
+
+	request := &snapshotRequest{snapshotKey: key, fromVersion: first.Version, toVersion: last.Version}
+	select {
+	case o.queue <- request:
+		o.pending[key] = request
+	default:
+	}
+}
+
+func (o *AutoSnapshots) run(ctx context.Context, queue <-chan *snapshotRequest, done chan<- struct{}) {
+	defer close(done)
+	for request := range queue {
+		o.mu.Lock()
+		delete(o.pending, request.snapshotKey)
+		o.mu.Unlock()
+
+		if err := o.take(ctx, request); err != nil {
+			o.Store.EventStore.App().Logger().Error("auto snapshot", "aggType", request.aggType,
+				"aggId", request.aggId, "error", err)
+		}
+	}
+}
+
+// take stores a snapshot of the aggregate, if it is due by the policy
+func (o *AutoSnapshots) take(ctx context.Context, request *snapshotRequest) (err error) {
+	var snapCol *SnapCol
+	if snapCol, err = o.Store.GetOrCreateForAggType(request.aggType); err != nil {
+		return
+	}
+
+	var last *SnapshotInfo
+	if last, err = snapCol.Info(ctx, request.aggId); err != nil {
+		return
+	}
+	if !o.Policy.Due(last, request.fromVersion, request.toVersion, time.Now()) {
+		return
+	}
+
+	var snapshot core.Snapshot
+	if snapshot, err = o.Snapshotter(ctx, request.aggType, request.aggId); err != nil {
+		return
+	}
+	if last != nil && snapshot.Version <= last.Version {
+		return
+	}
+
+	snapshot.ID = request.aggId
+	snapshot.Type = request.aggType
+	err = snapCol.Save(snapshot)
+	return
+}
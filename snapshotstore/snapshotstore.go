@@ -1,43 +1,78 @@
 package snapshotstore
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	es "github.com/go-ee/eventsoutcing_pocketbase"
 	"github.com/go-ee/eventsoutcing_pocketbase/db"
 	"github.com/go-ee/eventsoutcing_pocketbase/eventstore"
 	"github.com/hallgren/eventsourcing/core"
 	"github.com/pocketbase/dbx"
-	"github.com/pocketbase/pocketbase/daos"
-	"github.com/pocketbase/pocketbase/models"
-	"github.com/pocketbase/pocketbase/models/schema"
 	"github.com/pocketbase/pocketbase/tools/types"
+
+	pbcore "github.com/pocketbase/pocketbase/core"
 )
 
-const AggTypeFieldAggId = "agg_id"
-const AggTypeFieldVersion = "version"
-const AggTypeFieldGlobalVersion = "global_version"
+const AggTypeFieldAggId = eventstore.AggTypeFieldAggId
+const AggTypeFieldVersion = eventstore.AggTypeFieldVersion
+const AggTypeFieldGlobalVersion = eventstore.AggTypeFieldGlobalVersion
 const AggTypeFieldState = "state"
+const AggTypeFieldTakenAt = "taken_at"
+const AggTypeFieldSchemaVersion = "schema_version"
 
 func New(store *eventstore.Store) *StoreCollections {
 	return &StoreCollections{
-		ColBase:    &es.ColBase{Env: store.Env},
-		EventStore: store,
-
-		aggTypeCols: map[string]*SnapCol{},
+		EventStore:     store,
+		aggTypeCols:    map[string]*SnapCol{},
+		schemaVersions: map[string]int{},
 	}
 }
 
+// StoreCollections is a core.SnapshotStore with a snapshot collection per aggregate type.
+// The snapshot collections share the Env, the auth rules and the keys with the event collections.
 type StoreCollections struct {
-	*es.ColBase
 	EventStore *eventstore.Store
+	// Retention is the number of snapshots kept per aggregate by Prune, 0 keeps all
+	Retention int
+	// PurgeStale deletes the snapshots of an aggregate with a stale schema version, when they are read.
+	// Otherwise they are ignored.
+	PurgeStale bool
+
+	mu             sync.RWMutex
+	aggTypeCols    map[string]*SnapCol
+	schemaVersions map[string]int
+}
+
+// SetSchemaVersion registers the current version of the state of the aggregate type, 0 by default.
+// Snapshots of another schema version are stale, they are not returned, so the aggregate is rebuilt from its events.
+// It should be registered before the aggregate type is used.
+func (o *StoreCollections) SetSchemaVersion(aggType string, version int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.schemaVersions[aggType] = version
+	if snapCol := o.aggTypeCols[aggType]; snapCol != nil {
+		snapCol.SetSchemaVersion(version)
+	}
+}
 
-	aggTypeCols map[string]*SnapCol
-	auth        *db.AuthorizationBuilder
+// Invalidate deletes all snapshots of the aggregate type
+func (o *StoreCollections) Invalidate(ctx context.Context, aggType string) (ret int64, err error) {
+	var snapCol *SnapCol
+	if snapCol, err = o.GetOrCreateForAggType(aggType); err != nil {
+		return
+	}
+	ret, err = snapCol.Invalidate(ctx)
+	return
 }
 
+// Get returns the latest snapshot of the aggregate, core.ErrSnapshotNotFound if there is none
 func (o *StoreCollections) Get(
 	ctx context.Context, aggId string, aggregateType string) (ret core.Snapshot, err error) {
 
@@ -50,7 +85,21 @@ func (o *StoreCollections) Get(
 	return
 }
 
-// Save persists events to the collections for aggregate type
+// GetAtOrBefore returns the latest snapshot of the aggregate not beyond the version,
+// e.g. to load the aggregate as it was at that version
+func (o *StoreCollections) GetAtOrBefore(
+	ctx context.Context, aggId string, aggregateType string, version core.Version) (ret core.Snapshot, err error) {
+
+	var aggregateTypeCollection *SnapCol
+	if aggregateTypeCollection, err = o.GetOrCreateForAggType(aggregateType); err != nil {
+		return
+	}
+
+	ret, err = aggregateTypeCollection.GetAtOrBefore(ctx, aggId, aggregateType, version)
+	return
+}
+
+// Save adds the snapshot to the history of the aggregate, a snapshot of the same version is replaced
 func (o *StoreCollections) Save(snapshot core.Snapshot) (err error) {
 	var aggTypeCol *SnapCol
 	if aggTypeCol, err = o.GetOrCreateForAggType(snapshot.Type); err != nil {
@@ -61,168 +110,459 @@ func (o *StoreCollections) Save(snapshot core.Snapshot) (err error) {
 	return
 }
 
+// GetOrCreateForAggType returns the snapshot collection of the aggregate type, it is created if missing
 func (o *StoreCollections) GetOrCreateForAggType(aggType string) (ret *SnapCol, err error) {
+	o.mu.RLock()
 	ret = o.aggTypeCols[aggType]
-	if ret == nil {
-		var eventStore *eventstore.Aggregate
-		if eventStore, err = o.EventStore.GetOrCreateForAggType(aggType); err != nil {
+	o.mu.RUnlock()
+	if ret != nil {
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if ret = o.aggTypeCols[aggType]; ret != nil {
+		return
+	}
+
+	var aggregate *eventstore.Aggregate
+	if aggregate, err = o.EventStore.GetOrCreateForAggType(aggType); err != nil {
+		return
+	}
+
+	snapCol := NewSnapCol(aggregate)
+	snapCol.Keys = o.EventStore.Keys
+	snapCol.Retention = o.Retention
+	snapCol.SetSchemaVersion(o.schemaVersions[aggType])
+	snapCol.PurgeStale = o.PurgeStale
+	if err = snapCol.Load(); err != nil {
+		return
+	}
+	o.aggTypeCols[aggType] = snapCol
+	ret = snapCol
+	return
+}
+
+// Prune applies the Retention to the existing snapshot collections of all registered aggregate types
+func (o *StoreCollections) Prune(ctx context.Context) (ret int64, err error) {
+	var aggTypes map[string]string
+	if aggTypes, err = o.EventStore.AggregateTypes.FindAll(); err != nil {
+		return
+	}
+
+	for aggType := range aggTypes {
+		if _, findErr := o.EventStore.App().FindCollectionByNameOrId(buildAggregateTypeCollectionName(aggType)); findErr != nil {
+			continue
+		}
+
+		var snapCol *SnapCol
+		if snapCol, err = o.GetOrCreateForAggType(aggType); err != nil {
+			return
+		}
+
+		var deleted int64
+		if deleted, err = snapCol.Prune(ctx); err != nil {
 			return
 		}
-		ret = NewSnapCol(aggType, eventStore.Auth.AuthBuilder, o.Env)
-		o.aggTypeCols[aggType] = ret
+		ret += deleted
 	}
-	_, err = ret.CheckOrInit()
 	return
 }
 
+// PruneEvery runs Prune in the interval until ctx is done, the errors are logged
+func (o *StoreCollections) PruneEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := o.Prune(ctx); err != nil && ctx.Err() == nil {
+				o.EventStore.App().Logger().Error("prune snapshots", "error", err)
+			}
+		}
+	}
+}
+
 func buildAggregateTypeCollectionName(aggregationType string) (ret string) {
 	return fmt.Sprintf("%v_snap", es.ToSnakeCase(aggregationType))
 }
 
-func NewSnapshot(record *models.Record, aggregateType string) (ret *core.Snapshot) {
+func NewSnapshot(record *pbcore.Record, aggregateType string) (ret *core.Snapshot) {
 	ret = &core.Snapshot{
 		ID:            record.GetString(AggTypeFieldAggId),
 		Type:          aggregateType,
 		Version:       core.Version(record.GetInt(AggTypeFieldVersion)),
 		GlobalVersion: core.Version(record.GetInt(AggTypeFieldGlobalVersion)),
-		State:         record.Get(AggTypeFieldState).(types.JsonRaw),
+	}
+	if state, ok := record.Get(AggTypeFieldState).(types.JSONRaw); ok {
+		ret.State = state
 	}
 	return
 }
 
-func NewRecord(snapshot *core.Snapshot, coll *models.Collection) (ret *models.Record) {
-	ret = models.NewRecord(coll)
-
-	ret.Set(AggTypeFieldAggId, snapshot.ID)
-	ret.Set(AggTypeFieldVersion, uint64(snapshot.Version))
-	ret.Set(AggTypeFieldGlobalVersion, uint64(snapshot.GlobalVersion))
-	ret.Set(AggTypeFieldState, snapshot.State)
-	return
-}
-
-func NewSnapCol(aggregateType string, auth *db.AuthorizationBuilder, env es.Env) *SnapCol {
-	collectionName := buildAggregateTypeCollectionName(aggregateType)
+// NewSnapCol creates the snapshot collection of the aggregate type of the event collection
+func NewSnapCol(aggregate *eventstore.Aggregate) *SnapCol {
 	return &SnapCol{
-		ColBase:        &es.ColBase{Env: env},
-		auth:           auth,
-		CollectionName: collectionName,
-		AggregateType:  aggregateType,
+		CollectionBase: db.CollectionBase{
+			Name: buildAggregateTypeCollectionName(aggregate.AggregateType),
+			Env:  aggregate.Env,
+		},
+		auth:          aggregate.AuthBuilder.ForScope(aggregate.AggregateType),
+		AggregateType: aggregate.AggregateType,
 	}
 }
 
 type SnapCol struct {
-	*es.ColBase
-	auth           *db.AuthorizationBuilder
-	CollectionName string
-	AggregateType  string
+	db.CollectionBase
+	auth          *db.AuthorizationBuilder
+	AggregateType string
+	// Retention is the number of snapshots kept per aggregate by Prune, 0 keeps all
+	Retention int
+	// PurgeStale deletes the stale snapshots of an aggregate, when they are read
+	PurgeStale bool
+	// Keys encrypts the State of the snapshots with the key of the aggregate, if set
+	Keys *eventstore.Keys
+
+	// schemaVersion is the current version of the state, it may change while the collection is used
+	schemaVersion atomic.Int64
+}
+
+// SchemaVersion returns the current version of the state, see StoreCollections.SetSchemaVersion
+func (o *SnapCol) SchemaVersion() int {
+	return int(o.schemaVersion.Load())
+}
+
+func (o *SnapCol) SetSchemaVersion(version int) {
+	o.schemaVersion.Store(int64(version))
 }
 
-func (o *SnapCol) CheckOrInit() (ret bool, err error) {
-	if ret, err = o.ColBase.CheckOrInit(); ret || err != nil {
+func (o *SnapCol) Load() (err error) {
+	if o.Collection != nil && !o.IsRecreateDb() {
 		return
 	}
 
-	dao := o.App().Dao()
-
-	if o.Coll, err = dao.FindCollectionByNameOrId(o.CollectionName); o.Coll == nil || o.IsRecreateDb() {
-		if o.Coll != nil {
-			if err = dao.DeleteCollection(o.Coll); err != nil {
+	dao := o.App()
+	if o.Collection, err = dao.FindCollectionByNameOrId(o.Name); o.Collection == nil || o.IsRecreateDb() {
+		if o.Collection != nil {
+			if err = dao.Delete(o.Collection); err != nil {
 				return
 			}
 		}
 
-		o.Coll = &models.Collection{
-			Name: o.CollectionName,
-			Type: models.CollectionTypeBase,
-			Schema: schema.NewSchema(
-				&schema.SchemaField{
-					Name:     AggTypeFieldAggId,
-					Type:     schema.FieldTypeText,
-					Required: true,
-				},
-				&schema.SchemaField{
-					Name:     AggTypeFieldVersion,
-					Type:     schema.FieldTypeNumber,
-					Required: true,
-				},
-				&schema.SchemaField{
-					Name:     AggTypeFieldGlobalVersion,
-					Type:     schema.FieldTypeNumber,
-					Required: true,
-				},
-				&schema.SchemaField{
-					Name: AggTypeFieldState,
-					Type: schema.FieldTypeJson,
-					Options: schema.JsonOptions{
-						MaxSize: 102400,
-					},
-				},
-			),
-			Indexes: types.JsonArray[string]{fmt.Sprintf("CREATE INDEX idx_%v ON %v (%v)",
-				AggTypeFieldAggId, o.CollectionName, AggTypeFieldAggId),
+		o.Collection = pbcore.NewBaseCollection(o.Name)
+		o.Collection.Fields.Add(
+			&pbcore.TextField{
+				Name:     AggTypeFieldAggId,
+				Required: true,
+			},
+			&pbcore.NumberField{
+				Name:     AggTypeFieldVersion,
+				Required: true,
 			},
-			ListRule:   types.Pointer(o.auth.ListRule()),
-			ViewRule:   types.Pointer(o.auth.ViewRule()),
-			CreateRule: types.Pointer(o.auth.CreateRule()),
-			UpdateRule: types.Pointer(o.auth.UpdateRule()),
-			DeleteRule: types.Pointer(o.auth.DeleteRule()),
+			&pbcore.NumberField{
+				Name: AggTypeFieldGlobalVersion,
+			},
+			&pbcore.JSONField{
+				Name:    AggTypeFieldState,
+				MaxSize: eventstore.PayloadMaxSize,
+			},
+			&pbcore.DateField{
+				Name: AggTypeFieldTakenAt,
+			},
+			&pbcore.NumberField{
+				Name: AggTypeFieldSchemaVersion,
+			},
+		)
+		o.Collection.AddIndex(o.versionIndexName(), true, o.versionIndexColumns(), "")
+
+		if !o.IsAuthDisabled() {
+			o.Collection.ListRule = types.Pointer(o.auth.ListRule())
+			o.Collection.ViewRule = types.Pointer(o.auth.ViewRule())
+			o.Collection.CreateRule = types.Pointer(o.auth.CreateRule())
+			o.Collection.UpdateRule = types.Pointer(o.auth.UpdateRule())
+			o.Collection.DeleteRule = types.Pointer(o.auth.DeleteRule())
+		} else {
+			db.DisableAuth(o.Collection)
 		}
 
-		err = dao.SaveCollection(o.Coll)
+		err = dao.Save(o.Collection)
+	} else if err == nil {
+		err = o.migrate()
+	}
+	return
+}
+
+// migrate upgrades the schema of a collection created by an older version
+func (o *SnapCol) migrate() (err error) {
+	changed := false
+
+	if o.Collection.Fields.GetByName(AggTypeFieldTakenAt) == nil {
+		o.Collection.Fields.Add(&pbcore.DateField{Name: AggTypeFieldTakenAt})
+		changed = true
+	}
+	if o.Collection.Fields.GetByName(AggTypeFieldSchemaVersion) == nil {
+		o.Collection.Fields.Add(&pbcore.NumberField{Name: AggTypeFieldSchemaVersion})
+		changed = true
 	}
+
+	// the former unique index on agg_id allowed only one snapshot per aggregate
+	if formerIndex := fmt.Sprintf("idx_%v_%v", o.Name, AggTypeFieldAggId); o.Collection.GetIndex(formerIndex) != "" {
+		o.Collection.RemoveIndex(formerIndex)
+		o.Collection.AddIndex(o.versionIndexName(), true, o.versionIndexColumns(), "")
+		changed = true
+	}
+	// the former rules in the single collection storage granted access to the agg_id of any aggregate type
+	if !o.IsAuthDisabled() && !o.auth.HasScopedRules(o.Collection) {
+		o.Collection.ListRule = types.Pointer(o.auth.ListRule())
+		o.Collection.ViewRule = types.Pointer(o.auth.ViewRule())
+		o.Collection.CreateRule = types.Pointer(o.auth.CreateRule())
+		o.Collection.UpdateRule = types.Pointer(o.auth.UpdateRule())
+		o.Collection.DeleteRule = types.Pointer(o.auth.DeleteRule())
+		changed = true
+	}
+
+	if changed {
+		if err = o.App().Save(o.Collection); err != nil {
+			err = fmt.Errorf("migrate the collection %v: %w", o.Name, err)
+		}
+	}
+	return
+}
+
+func (o *SnapCol) versionIndexName() string {
+	return fmt.Sprintf("idx_%v_%v_%v", o.Name, AggTypeFieldAggId, AggTypeFieldVersion)
+}
+
+func (o *SnapCol) versionIndexColumns() string {
+	return fmt.Sprintf("%v, %v", AggTypeFieldAggId, AggTypeFieldVersion)
+}
+
+// Get returns the latest snapshot of the aggregate, core.ErrSnapshotNotFound if there is none.
+// A snapshot of an aggregate with a destroyed key is not found as well.
+func (o *SnapCol) Get(ctx context.Context, aggId string, aggregateType string) (ret core.Snapshot, err error) {
+	ret, err = o.get(ctx, aggId, aggregateType, dbx.HashExp{AggTypeFieldAggId: aggId})
+	return
+}
+
+// GetAtOrBefore returns the latest snapshot of the aggregate not beyond the version
+func (o *SnapCol) GetAtOrBefore(
+	ctx context.Context, aggId string, aggregateType string, version core.Version) (ret core.Snapshot, err error) {
+
+	ret, err = o.get(ctx, aggId, aggregateType, dbx.And(
+		dbx.HashExp{AggTypeFieldAggId: aggId},
+		dbx.NewExp(fmt.Sprintf("%v <= {:%v}", AggTypeFieldVersion, AggTypeFieldVersion),
+			dbx.Params{AggTypeFieldVersion: uint64(version)}),
+	))
 	return
 }
 
-func (o *SnapCol) Get(
-	_ context.Context, aggId string, aggregateType string) (ret core.Snapshot, err error) {
-	fmt.Printf("aggregateType: %v, %v: %v", aggregateType, AggTypeFieldAggId, aggId)
+func (o *SnapCol) get(
+	ctx context.Context, aggId string, aggregateType string, where dbx.Expression) (ret core.Snapshot, err error) {
+
+	var record *pbcore.Record
+	if record, err = o.findCurrent(ctx, aggId, where); err != nil {
+		return
+	}
+	if record == nil {
+		err = fmt.Errorf("%w: %v %v", core.ErrSnapshotNotFound, aggregateType, aggId)
+		return
+	}
 
-	dao := o.App().Dao()
+	ret = *NewSnapshot(record, aggregateType)
+	err = o.decrypt(&ret)
+	return
+}
 
-	var record *models.Record
-	if record, err = dao.FindFirstRecordByFilter(o.Coll.Id,
-		fmt.Sprintf("%v = {:%v}", AggTypeFieldAggId, AggTypeFieldAggId),
-		dbx.Params{AggTypeFieldAggId: aggId},
-	); err != nil {
-		//TODO maybe we need to ignore );sql.ErrNoRows {
+// GetTx returns the latest snapshot of the current schema version read with the builder,
+// e.g. within db.RunInReadTransaction. Stale snapshots are not purged.
+func (o *SnapCol) GetTx(
+	ctx context.Context, tx dbx.Builder, aggId string, aggregateType string) (ret core.Snapshot, err error) {
+
+	row := snapshotRow{}
+	if err = tx.Select(AggTypeFieldVersion, AggTypeFieldGlobalVersion, AggTypeFieldState).
+		From(o.Name).
+		WithContext(ctx).
+		Where(dbx.HashExp{AggTypeFieldAggId: aggId}).
+		AndWhere(o.currentSchema()).
+		OrderBy(AggTypeFieldVersion + " DESC").
+		Limit(1).
+		One(&row); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = fmt.Errorf("%w: %v %v", core.ErrSnapshotNotFound, aggregateType, aggId)
+		}
 		return
 	}
 
 	ret = core.Snapshot{
 		ID:            aggId,
 		Type:          aggregateType,
-		Version:       core.Version(record.GetInt(AggTypeFieldVersion)),
-		GlobalVersion: core.Version(record.GetInt(AggTypeFieldGlobalVersion)),
-		State:         record.Get(AggTypeFieldState).(types.JsonRaw),
+		Version:       core.Version(row.Version),
+		GlobalVersion: core.Version(row.GlobalVersion),
+		State:         row.State,
 	}
+	err = o.decrypt(&ret)
+	return
+}
 
+// snapshotRow is a snapshot record read without a pbcore.Record
+type snapshotRow struct {
+	Version       int64         `db:"version"`
+	GlobalVersion int64         `db:"global_version"`
+	State         types.JSONRaw `db:"state"`
+}
+
+// decrypt replaces the State by the decrypted state, a redacted snapshot is not found
+func (o *SnapCol) decrypt(snapshot *core.Snapshot) (err error) {
+	if o.Keys == nil {
+		return
+	}
+	if snapshot.State, err = o.Keys.Decrypt(snapshot.Type, snapshot.ID, snapshot.State); err != nil {
+		return
+	}
+	if bytes.Equal(snapshot.State, eventstore.RedactedData) {
+		err = fmt.Errorf("%w: %v %v is redacted", core.ErrSnapshotNotFound, snapshot.Type, snapshot.ID)
+		*snapshot = core.Snapshot{}
+	}
 	return
 }
 
-// Save persists events to the collections for aggregate type
+// SnapshotInfo describes a stored snapshot without its state
+type SnapshotInfo struct {
+	Version core.Version
+	TakenAt time.Time
+}
+
+// Info returns the version and the time of the latest snapshot of the aggregate, nil if it has none
+func (o *SnapCol) Info(ctx context.Context, aggId string) (ret *SnapshotInfo, err error) {
+	var record *pbcore.Record
+	if record, err = o.findCurrent(ctx, aggId, dbx.HashExp{AggTypeFieldAggId: aggId}); err != nil || record == nil {
+		return
+	}
+	ret = &SnapshotInfo{
+		Version: core.Version(record.GetInt(AggTypeFieldVersion)),
+		TakenAt: record.GetDateTime(AggTypeFieldTakenAt).Time(),
+	}
+	return
+}
+
+// Save adds the snapshot to the history of the aggregate, a snapshot of the same version is replaced
 func (o *SnapCol) Save(snapshot core.Snapshot) (err error) {
-	dao := o.App().Dao()
-
-	err = dao.RunInTransaction(func(txDao *daos.Dao) (txErr error) {
-		fmt.Printf("aggregateType: %v, %v: %v", snapshot.Type, AggTypeFieldAggId, snapshot.ID)
-		var record *models.Record
-		if record, txErr = txDao.FindFirstRecordByFilter(o.Coll.Id,
-			fmt.Sprintf("%v = {:%v}", AggTypeFieldAggId, AggTypeFieldAggId),
-			dbx.Params{AggTypeFieldAggId: snapshot.ID},
-		); txErr != nil && !errors.Is(txErr, sql.ErrNoRows) {
+	err = o.App().RunInTransaction(func(txApp pbcore.App) (txErr error) {
+		var record *pbcore.Record
+		if record, txErr = o.findTx(txApp, context.Background(), dbx.HashExp{
+			AggTypeFieldAggId:   snapshot.ID,
+			AggTypeFieldVersion: uint64(snapshot.Version),
+		}); txErr != nil {
 			return
 		}
 
 		if record == nil {
-			record = models.NewRecord(o.Coll)
+			record = pbcore.NewRecord(o.Collection)
 			record.Set(AggTypeFieldAggId, snapshot.ID)
+			record.Set(AggTypeFieldVersion, uint64(snapshot.Version))
+		}
+
+		state := snapshot.State
+		if o.Keys != nil {
+			if state, txErr = o.Keys.EncryptTx(txApp, snapshot.Type, snapshot.ID, state); txErr != nil {
+				return
+			}
 		}
-		record.Set(AggTypeFieldVersion, uint64(snapshot.Version))
+
 		record.Set(AggTypeFieldGlobalVersion, uint64(snapshot.GlobalVersion))
-		record.Set(AggTypeFieldState, snapshot.State)
+		record.Set(AggTypeFieldState, state)
+		record.Set(AggTypeFieldTakenAt, time.Now())
+		record.Set(AggTypeFieldSchemaVersion, o.SchemaVersion())
 
-		txErr = txDao.Save(record)
+		txErr = txApp.Save(record)
 		return
 	})
 	return
 }
+
+// Prune deletes the snapshots of each aggregate beyond the Retention latest ones
+func (o *SnapCol) Prune(ctx context.Context) (ret int64, err error) {
+	if o.Retention <= 0 {
+		return
+	}
+
+	var result sql.Result
+	if result, err = o.App().DB().NewQuery(fmt.Sprintf(
+		"DELETE FROM {{%[1]v}} WHERE [[id]] IN (SELECT [[id]] FROM ("+
+			"SELECT [[id]], ROW_NUMBER() OVER (PARTITION BY [[%[2]v]] ORDER BY [[%[3]v]] DESC) AS [[rank]] "+
+			"FROM {{%[1]v}}) WHERE [[rank]] > {:retention})",
+		o.Name, AggTypeFieldAggId, AggTypeFieldVersion)).
+		WithContext(ctx).
+		Bind(dbx.Params{"retention": o.Retention}).
+		Execute(); err != nil {
+		return
+	}
+	ret, err = result.RowsAffected()
+	return
+}
+
+// Invalidate deletes all snapshots, e.g. after an incompatible change of the state
+func (o *SnapCol) Invalidate(ctx context.Context) (ret int64, err error) {
+	ret, err = o.deleteWhere(ctx, nil)
+	return
+}
+
+// PurgeStaleSnapshots deletes the snapshots of another than the current schema version
+func (o *SnapCol) PurgeStaleSnapshots(ctx context.Context) (ret int64, err error) {
+	ret, err = o.deleteWhere(ctx, dbx.Not(o.currentSchema()))
+	return
+}
+
+func (o *SnapCol) deleteWhere(ctx context.Context, where dbx.Expression) (ret int64, err error) {
+	var result sql.Result
+	if result, err = o.App().DB().Delete(o.Name, where).WithContext(ctx).Execute(); err != nil {
+		return
+	}
+	ret, err = result.RowsAffected()
+	return
+}
+
+func (o *SnapCol) currentSchema() dbx.Expression {
+	return dbx.HashExp{AggTypeFieldSchemaVersion: o.SchemaVersion()}
+}
+
+// findCurrent returns the latest snapshot record of the current schema version matching the expression.
+// The stale snapshots of the aggregate are purged, if the latest one is stale and PurgeStale is set.
+func (o *SnapCol) findCurrent(ctx context.Context, aggId string, where dbx.Expression) (ret *pbcore.Record, err error) {
+	if ret, err = o.findTx(o.App(), ctx, where); err != nil || ret == nil {
+		return
+	}
+	if ret.GetInt(AggTypeFieldSchemaVersion) == o.SchemaVersion() {
+		return
+	}
+
+	if o.PurgeStale {
+		if _, err = o.deleteWhere(ctx, dbx.And(
+			dbx.HashExp{AggTypeFieldAggId: aggId}, dbx.Not(o.currentSchema()))); err != nil {
+			return
+		}
+	}
+	ret, err = o.findTx(o.App(), ctx, dbx.And(where, o.currentSchema()))
+	return
+}
+
+// findTx returns the snapshot record with the highest version matching the expression, nil if there is none
+func (o *SnapCol) findTx(txApp pbcore.App, ctx context.Context, where dbx.Expression) (ret *pbcore.Record, err error) {
+	var record pbcore.Record
+	if err = txApp.RecordQuery(o.Collection).
+		WithContext(ctx).
+		AndWhere(where).
+		OrderBy(AggTypeFieldVersion + " DESC").
+		Limit(1).
+		One(&record); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = nil
+		}
+		return
+	}
+	ret = &record
+	return
+}
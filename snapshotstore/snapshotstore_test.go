@@ -0,0 +1,322 @@
+package snapshotstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-ee/eventsoutcing_pocketbase/db"
+	"github.com/go-ee/eventsoutcing_pocketbase/eventstore"
+	"github.com/go-ee/eventsoutcing_pocketbase/internal/testapp"
+	"github.com/hallgren/eventsourcing/core"
+	"github.com/hallgren/eventsourcing/core/testsuite"
+	"github.com/pocketbase/dbx"
+)
+
+func TestSuite(t *testing.T) {
+	f := func() (store core.SnapshotStore, closeFunc func(), err error) {
+		appInst, user := testapp.New(t)
+		eventStore := eventstore.New(user, testapp.AuthRoles, appInst)
+		if err = eventStore.Load(); err != nil {
+			return
+		}
+		store = New(eventStore)
+
+		closeFunc = func() {
+		}
+		return
+	}
+	testsuite.TestSnapshotStore(t, f)
+}
+
+func TestHistory(t *testing.T) {
+	store := newTestStore(t, nil)
+	store.Retention = 2
+
+	for version := core.Version(1); version <= 3; version++ {
+		if err := store.Save(core.Snapshot{ID: "p1", Type: "Person", Version: version, GlobalVersion: version,
+			State: []byte(fmt.Sprintf(`{"version":%d}`, version))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a snapshot of the same version is replaced
+	if err := store.Save(core.Snapshot{ID: "p1", Type: "Person", Version: 3, GlobalVersion: 3,
+		State: []byte(`{"version":"3b"}`)}); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := store.Get(context.Background(), "p1", "Person")
+	if err != nil || snapshot.Version != 3 || string(snapshot.State) != `{"version":"3b"}` {
+		t.Fatalf("unexpected latest snapshot %+v, %v", snapshot, err)
+	}
+	snapshot, err = store.GetAtOrBefore(context.Background(), "p1", "Person", 2)
+	if err != nil || snapshot.Version != 2 || string(snapshot.State) != `{"version":2}` {
+		t.Fatalf("unexpected snapshot at version 2 %+v, %v", snapshot, err)
+	}
+
+	snapCol, err := store.GetOrCreateForAggType("Person")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count, err := snapCol.App().CountRecords(snapCol.Collection); err != nil || count != 3 {
+		t.Fatalf("expected three snapshot records, got %v, %v", count, err)
+	}
+
+	if deleted, err := store.Prune(context.Background()); err != nil || deleted != 1 {
+		t.Fatalf("expected one pruned snapshot, got %v, %v", deleted, err)
+	}
+	if _, err = store.GetAtOrBefore(context.Background(), "p1", "Person", 1); !errors.Is(err, core.ErrSnapshotNotFound) {
+		t.Fatalf("expected the pruned snapshot not found, got %v", err)
+	}
+
+	// the snapshot collection has the auth rules of the event collection
+	aggregate, err := store.EventStore.GetOrCreateForAggType("Person")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *snapCol.Collection.ListRule != *aggregate.Collection.ListRule ||
+		*snapCol.Collection.UpdateRule != *aggregate.Collection.UpdateRule {
+		t.Fatalf("expected the rules of the event collection, got %v", *snapCol.Collection.ListRule)
+	}
+}
+
+func TestSchemaVersion(t *testing.T) {
+	store := newTestStore(t, nil)
+	store.PurgeStale = true
+	ctx := context.Background()
+
+	save := func(aggId string, version core.Version) {
+		t.Helper()
+		if err := store.Save(core.Snapshot{ID: aggId, Type: "Person", Version: version, GlobalVersion: version,
+			State: []byte(`{"name":"test"}`)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	save("p1", 1)
+	save("p2", 1)
+
+	// the schema version may change, while the snapshot collection is used
+	snapCol, err := store.GetOrCreateForAggType("Person")
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := make(chan struct{})
+	go func() {
+		defer close(read)
+		_, _ = snapCol.Get(ctx, "p2", "Person")
+	}()
+	store.SetSchemaVersion("Person", 2)
+	<-read
+
+	if _, err := store.Get(ctx, "p1", "Person"); !errors.Is(err, core.ErrSnapshotNotFound) {
+		t.Fatalf("expected the stale snapshot not found, got %v", err)
+	}
+
+	save("p2", 2)
+	if snapshot, err := store.Get(ctx, "p2", "Person"); err != nil || snapshot.Version != 2 {
+		t.Fatalf("unexpected snapshot %+v, %v", snapshot, err)
+	}
+	if _, err := store.GetAtOrBefore(ctx, "p2", "Person", 1); !errors.Is(err, core.ErrSnapshotNotFound) {
+		t.Fatalf("expected the stale snapshot not found, got %v", err)
+	}
+
+	// the stale snapshots were purged when they were read
+	if count, err := snapCol.App().CountRecords(snapCol.Collection); err != nil || count != 1 {
+		t.Fatalf("expected one snapshot record, got %v, %v", count, err)
+	}
+
+	if deleted, err := store.Invalidate(ctx, "Person"); err != nil || deleted != 1 {
+		t.Fatalf("expected one invalidated snapshot, got %v, %v", deleted, err)
+	}
+	if _, err = store.Get(ctx, "p2", "Person"); !errors.Is(err, core.ErrSnapshotNotFound) {
+		t.Fatalf("expected no snapshot after invalidation, got %v", err)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	for _, storage := range []eventstore.Storage{eventstore.StorageCollectionPerType, eventstore.StorageSingleCollection} {
+		t.Run(storage.String(), func(t *testing.T) {
+			appInst, user := testapp.New(t)
+			eventStore := eventstore.New(user, testapp.AuthRoles, appInst)
+			eventStore.Storage = storage
+			if err := eventStore.Load(); err != nil {
+				t.Fatal(err)
+			}
+			store := New(eventStore)
+			ctx := context.Background()
+
+			save := func(aggId string, version core.Version) {
+				t.Helper()
+				if err := eventStore.Save([]core.Event{{AggregateID: aggId, AggregateType: "Person", Version: version,
+					Timestamp: time.Now(), Reason: "Created", Data: []byte(`{}`)}}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for version := core.Version(1); version <= 3; version++ {
+				save("p1", version)
+			}
+			save("p2", 1)
+
+			loaded, err := store.Load(ctx, "Person", "p1")
+			if err != nil || loaded.Snapshot != nil || len(loaded.Events) != 3 || loaded.Version() != 3 {
+				t.Fatalf("unexpected load without snapshot %+v, %v", loaded, err)
+			}
+
+			if err = store.Save(core.Snapshot{ID: "p1", Type: "Person", Version: 2, GlobalVersion: 2,
+				State: []byte(`{"version":2}`)}); err != nil {
+				t.Fatal(err)
+			}
+			save("p1", 4)
+
+			loaded, err = store.Load(ctx, "Person", "p1")
+			if err != nil || loaded.Snapshot == nil || loaded.Snapshot.Version != 2 ||
+				string(loaded.Snapshot.State) != `{"version":2}` || len(loaded.Events) != 2 ||
+				loaded.Events[0].Version != 3 || loaded.Version() != 4 {
+				t.Fatalf("unexpected load with snapshot %+v, %v", loaded, err)
+			}
+
+			// loads during appends see the events contiguous after the snapshot
+			done := make(chan error)
+			go func() {
+				var err error
+				for version := core.Version(5); version <= 30 && err == nil; version++ {
+					err = eventStore.Save([]core.Event{{AggregateID: "p1", AggregateType: "Person", Version: version,
+						Timestamp: time.Now(), Reason: "Created", Data: []byte(`{}`)}})
+				}
+				done <- err
+			}()
+			for i := 0; i < 20; i++ {
+				if loaded, err = store.Load(ctx, "Person", "p1"); err != nil {
+					t.Fatal(err)
+				}
+				for j, event := range loaded.Events {
+					if event.Version != loaded.Snapshot.Version+core.Version(j+1) {
+						t.Fatalf("unexpected events after the snapshot %+v", loaded.Events)
+					}
+				}
+			}
+			if err = <-done; err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	store := newTestStore(t, bytes.Repeat([]byte{7}, 32))
+
+	if err := store.Save(core.Snapshot{ID: "p1", Type: "Person", Version: 1, GlobalVersion: 1,
+		State: []byte(`{"name":"test"}`)}); err != nil {
+		t.Fatal(err)
+	}
+
+	snapCol, err := store.GetOrCreateForAggType("Person")
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := snapCol.findTx(snapCol.App(), context.Background(), dbx.HashExp{AggTypeFieldAggId: "p1"})
+	if err != nil || record == nil || strings.Contains(record.GetString(AggTypeFieldState), "test") {
+		t.Fatalf("expected encrypted state, got %v, %v", record, err)
+	}
+
+	if snapshot, err := store.Get(context.Background(), "p1", "Person"); err != nil ||
+		string(snapshot.State) != `{"name":"test"}` {
+		t.Fatalf("expected the decrypted state, got %+v, %v", snapshot, err)
+	}
+
+	if err = store.EventStore.Keys.Destroy("Person", "p1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.Get(context.Background(), "p1", "Person"); !errors.Is(err, core.ErrSnapshotNotFound) {
+		t.Fatalf("expected snapshot not found after the key is destroyed, got %v", err)
+	}
+}
+
+func TestPolicyDue(t *testing.T) {
+	now := time.Now()
+	last := &SnapshotInfo{Version: 10, TakenAt: now.Add(-time.Hour)}
+
+	tests := []struct {
+		policy   Policy
+		last     *SnapshotInfo
+		from, to core.Version
+		due      bool
+	}{
+		{Policy{Every: 10}, nil, 1, 9, false},
+		{Policy{Every: 10}, nil, 9, 11, true},
+		{Policy{Threshold: 5}, last, 11, 15, false},
+		{Policy{Threshold: 5}, last, 11, 16, true},
+		{Policy{Threshold: 5}, nil, 1, 6, true},
+		{Policy{MaxAge: time.Minute}, last, 11, 11, true},
+		{Policy{MaxAge: 2 * time.Hour}, last, 11, 11, false},
+		{Policy{MaxAge: time.Minute}, nil, 1, 1, false},
+	}
+	for i, test := range tests {
+		if due := test.policy.Due(test.last, test.from, test.to, now); due != test.due {
+			t.Errorf("%d: expected due %v, got %v", i, test.due, due)
+		}
+	}
+}
+
+func TestAutoSnapshots(t *testing.T) {
+	store := newTestStore(t, nil)
+
+	auto := NewAutoSnapshots(store, Policy{Every: 2}, func(
+		ctx context.Context, aggType string, aggId string) (ret core.Snapshot, err error) {
+
+		var iterator core.Iterator
+		if iterator, err = store.EventStore.Get(ctx, aggId, aggType, 0); err != nil {
+			return
+		}
+		defer iterator.Close()
+		for iterator.Next() {
+			var event core.Event
+			if event, err = iterator.Value(); err != nil {
+				return
+			}
+			ret.Version, ret.GlobalVersion = event.Version, event.GlobalVersion
+		}
+		ret.State = []byte(fmt.Sprintf(`{"count":%d}`, ret.Version))
+		return
+	})
+	if err := auto.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	for version := core.Version(1); version <= 4; version++ {
+		if err := store.EventStore.Save([]core.Event{{AggregateID: "p1", AggregateType: "Person", Version: version,
+			Timestamp: time.Now(), Reason: "Created", Data: []byte(`{}`)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	auto.Stop()
+
+	snapshot, err := store.Get(context.Background(), "p1", "Person")
+	if err != nil || snapshot.Version != 4 || string(snapshot.State) != `{"count":4}` {
+		t.Fatalf("unexpected snapshot %+v, %v", snapshot, err)
+	}
+}
+
+func newTestStore(t *testing.T, masterKey []byte) (ret *StoreCollections) {
+	t.Helper()
+	appInst, user := testapp.New(t)
+
+	var env db.Env = appInst
+	if masterKey != nil {
+		env = appInst.WithMasterKey(masterKey)
+	}
+
+	eventStore := eventstore.New(user, testapp.AuthRoles, env)
+	if masterKey != nil {
+		eventStore.Keys = eventstore.NewKeys(env)
+	}
+	if err := eventStore.Load(); err != nil {
+		t.Fatal(err)
+	}
+	ret = New(eventStore)
+	return
+}